@@ -16,17 +16,29 @@ import (
 // the input buffer ends with a newline
 func (p *parser) block(out *bytes.Buffer, input []byte) {
 	if len(input) == 0 || input[len(input)-1] != '\n' {
-		panic("block input is missing terminating newline")
+		panic(ErrMissingNewline)
 	}
 
 	// this is called recursively: enforce a maximum depth
 	if p.nesting >= p.maxNesting {
+		p.truncate(out, ErrTooDeep, input)
 		return
 	}
 	p.nesting++
 
 	// parse out one block-level construct at a time
-	for len(input) > 0 {
+	for len(input) > 0 && !p.stopped {
+		p.move(input)
+		p.checkContext()
+
+		// a finished top-level block is checked and written out right away
+		if out == p.top && !p.endTopBlock(out, input) {
+			break
+		}
+		if p.checkOutput(out); p.stopped {
+			break
+		}
+
 		// prefixed header
 		//
 		// # Header 1
@@ -44,14 +56,168 @@ func (p *parser) block(out *bytes.Buffer, input []byte) {
 			continue
 		}
 
+		// raw html block:
+		//
+		// <div>
+		//     ...
+		// </div>
+		if input[0] == '<' {
+			if i := p.html(out, input, true); i > 0 {
+				input = input[i:]
+				continue
+			}
+		}
+
+		// indented code block:
+		//
+		//     func max(a, b int) int {
+		//         if a > b {
+		//             return a
+		//         }
+		//         return b
+		//     }
+		if p.codePrefix(input) > 0 {
+			input = input[p.code(out, input):]
+			continue
+		}
+
+		// fenced code block:
+		//
+		// ``` go
+		// func fact(n int) int {
+		//     if n <= 1 {
+		//         return n
+		//     }
+		//     return n * fact(n-1)
+		// }
+		// ```
+		if p.flags&EXTENSION_FENCED_CODE != 0 {
+			if i := p.fencedCode(out, input, true); i > 0 {
+				input = input[i:]
+				continue
+			}
+		}
+
+		// block quote:
+		//
+		// > A big quote I found somewhere
+		// > on the web
+		if p.quotePrefix(input) > 0 {
+			input = input[p.quote(out, input):]
+			continue
+		}
+
+		// table:
+		//
+		// Name  | Age | Phone
+		// ------|-----|---------
+		// Bob   | 31  | 555-1234
+		// Alice | 27  | 555-4321
+		if p.flags&EXTENSION_TABLES != 0 {
+			if i := p.table(out, input); i > 0 {
+				input = input[i:]
+				continue
+			}
+		}
+
+		// horizontal rule:
+		//
+		// ------
+		// or
+		// ******
+		// or
+		// ______
+		if p.isHRule(input) {
+			end := skipUntilChar(input, 0, '\n')
+			p.blockSpan(input[:end])
+			p.r.HRule(out)
+			input = input[end+1:]
+			continue
+		}
+
+		// an itemized/unordered list:
+		//
+		// * Item 1
+		// * Item 2
+		//
+		// also works with + or -
+		if p.uliPrefix(input) > 0 {
+			input = input[p.list(out, input, 0):]
+			continue
+		}
+
+		// a numbered/ordered list:
+		//
+		// 1. Item 1
+		// 2. Item 2
+		if p.oliPrefix(input) > 0 {
+			input = input[p.list(out, input, LIST_TYPE_ORDERED):]
+			continue
+		}
+
+		// definition lists:
+		//
+		// Term 1
+		// :   Definition a
+		// :   Definition b
+		//
+		// Term 2
+		// :   Definition c
+		if p.flags&EXTENSION_DEFINITION_LISTS != 0 && p.dlTermEnd(input) > 0 {
+			input = input[p.list(out, input, LIST_TYPE_DEFINITION):]
+			continue
+		}
+
 		// anything else must look like a normal paragraph
 		input = input[p.paragraph(out, input):]
 	}
+	if out == p.top && !p.stopped {
+		p.endTopBlock(out, input)
+	}
 	p.nesting--
 }
 
+// titleBlock parses a pandoc style title block of % lines at the start of
+// the document, and returns its size. A line starting with a space continues
+// the field above it.
+func (p *parser) titleBlock(out *bytes.Buffer, data []byte) int {
+	// the title line needs a space after its %, so that text such as
+	// "%d" is no title
+	if len(data) < 2 || data[0] != '%' || data[1] != ' ' {
+		return 0
+	}
+
+	var fields bytes.Buffer
+	i := 0
+	for i < len(data) && (isTitleField(data[i:]) || (data[i] == ' ' && p.isEmpty(data[i:]) == 0)) {
+		p.checkContext()
+		end := skipUntilChar(data, i, '\n')
+		line := data[i:end]
+		if line[0] == '%' {
+			if i > 0 {
+				fields.WriteByte('\n')
+			}
+			line = line[1:]
+		} else if b := fields.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+			fields.WriteByte(' ')
+		}
+		fields.Write(bytes.TrimSpace(line))
+		i = end + 1
+	}
+
+	p.blockSpan(data[:i])
+	p.r.TitleBlock(out, fields.Bytes())
+	return i
+}
+
+// isTitleField tells whether data starts with a field of a title block: a %
+// followed by a space, or alone on its line for a field left empty
+func isTitleField(data []byte) bool {
+	return len(data) > 1 && data[0] == '%' && (data[1] == ' ' || data[1] == '\n')
+}
+
 func (p *parser) isPrefixHeader(input []byte) bool {
-	if input[0] != '#' {
+	if len(input) == 0 || input[0] != '#' {
 		return false
 	}
 
@@ -60,7 +226,7 @@ func (p *parser) isPrefixHeader(input []byte) bool {
 		for level < 6 && level < len(input) && input[level] == '#' {
 			level++
 		}
-		if input[level] != ' ' {
+		if level == len(input) || input[level] != ' ' {
 			return false
 		}
 	}
@@ -69,7 +235,7 @@ func (p *parser) isPrefixHeader(input []byte) bool {
 
 func (p *parser) prefixHeader(out *bytes.Buffer, input []byte) int {
 	level := 0
-	for level < 6 && input[level] == '#' {
+	for level < 6 && level < len(input) && input[level] == '#' {
 		level++
 	}
 
@@ -117,6 +283,7 @@ func (p *parser) prefixHeader(out *bytes.Buffer, input []byte) int {
 			p.inline(out, input[start:end])
 			return true
 		}
+		p.blockSpan(input[:skip])
 		p.r.Header(out, work, level, id)
 	}
 
@@ -124,11 +291,15 @@ func (p *parser) prefixHeader(out *bytes.Buffer, input []byte) int {
 }
 
 func (p *parser) isUnderlineHeader(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+
 	// test if level 1 header
 	if data[0] == '=' {
 		i := skipChar(data, 1, '=')
 		i = skipChar(data, i, ' ')
-		if data[i] == '\n' {
+		if i < len(data) && data[i] == '\n' {
 			return 1
 		} else {
 			return 0
@@ -139,7 +310,7 @@ func (p *parser) isUnderlineHeader(data []byte) int {
 	if data[0] == '-' {
 		i := skipChar(data, 1, '-')
 		i = skipChar(data, i, ' ')
-		if data[i] == '\n' {
+		if i < len(data) && data[i] == '\n' {
 			return 2
 		} else {
 			return 0
@@ -149,6 +320,36 @@ func (p *parser) isUnderlineHeader(data []byte) int {
 	return 0
 }
 
+// isHRule tells whether the line is a horizontal rule: three or more
+// matching '*', '-' or '_' characters, optionally separated by spaces
+func (p *parser) isHRule(data []byte) bool {
+	i := 0
+
+	// skip up to three spaces
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+
+	// look at the hrule char
+	if i >= len(data) || (data[i] != '*' && data[i] != '-' && data[i] != '_') {
+		return false
+	}
+	c := data[i]
+
+	// the whole line must be the char or whitespace
+	n := 0
+	for ; i < len(data) && data[i] != '\n'; i++ {
+		switch {
+		case data[i] == c:
+			n++
+		case data[i] != ' ':
+			return false
+		}
+	}
+
+	return n >= 3
+}
+
 func (p *parser) isEmpty(data []byte) int {
 	// it is okay to call isEmpty on an empty buffer
 	if len(data) == 0 {
@@ -161,8 +362,213 @@ func (p *parser) isEmpty(data []byte) int {
 			return 0
 		}
 	}
+	if i < len(data) {
+		i++
+	}
+
+	return i
+}
+
+// blockTags are the html tags that may open a raw html block
+var blockTags = map[string]bool{
+	"address":    true,
+	"article":    true,
+	"aside":      true,
+	"blockquote": true,
+	"canvas":     true,
+	"center":     true,
+	"del":        true,
+	"details":    true,
+	"dialog":     true,
+	"div":        true,
+	"dl":         true,
+	"fieldset":   true,
+	"figcaption": true,
+	"figure":     true,
+	"footer":     true,
+	"form":       true,
+	"h1":         true,
+	"h2":         true,
+	"h3":         true,
+	"h4":         true,
+	"h5":         true,
+	"h6":         true,
+	"header":     true,
+	"hgroup":     true,
+	"hr":         true,
+	"iframe":     true,
+	"ins":        true,
+	"main":       true,
+	"math":       true,
+	"nav":        true,
+	"noscript":   true,
+	"ol":         true,
+	"p":          true,
+	"pre":        true,
+	"script":     true,
+	"section":    true,
+	"style":      true,
+	"summary":    true,
+	"table":      true,
+	"ul":         true,
+	"video":      true,
+}
+
+// html parses a raw html block: a block tag and everything up to its
+// matching closing tag, which must end a line and, unless
+// EXTENSION_LAX_HTML_BLOCKS is set, be followed by a blank line. With
+// EXTENSION_LAX_HTML_BLOCKS an unclosed block runs to the next blank line.
+// Comments and single line elements such as <hr> are blocks on their own.
+func (p *parser) html(out *bytes.Buffer, data []byte, doRender bool) int {
+	if len(data) < 2 || data[0] != '<' {
+		return 0
+	}
+
+	var end int
+	if bytes.HasPrefix(data, []byte("<!--")) {
+		end = p.htmlComment(data)
+	} else {
+		tag, size := htmlBlockTag(data)
+		if tag == "" {
+			return 0
+		}
+		if tag == "hr" || data[size-2] == '/' {
+			// a void element is a block when nothing else is on its line
+			end = p.isEmpty(data[size:])
+			if end > 0 {
+				end += size
+			}
+		} else {
+			end = p.htmlFindEnd(data, tag)
+		}
+	}
+
+	if end == 0 && p.flags&EXTENSION_LAX_HTML_BLOCKS != 0 {
+		// an unclosed block ends with the paragraph it opens
+		for end < len(data) && p.isEmpty(data[end:]) == 0 {
+			end = skipLine(data, end)
+		}
+	}
+	if end == 0 {
+		return 0
+	}
+
+	if doRender {
+		// trim newlines
+		eol := end
+		for eol > 0 && data[eol-1] == '\n' {
+			eol--
+		}
+		p.span(data[:eol])
+		p.r.BlockHtml(out, data[:eol])
+	}
+
+	return end
+}
+
+// htmlBlockOpens tells whether data starts with a comment or an opening
+// block tag, without looking for where the block ends
+func htmlBlockOpens(data []byte) bool {
+	if len(data) < 2 || data[0] != '<' {
+		return false
+	}
+	if bytes.HasPrefix(data, []byte("<!--")) {
+		return true
+	}
+	tag, _ := htmlBlockTag(data)
+	return tag != ""
+}
+
+// htmlBlockTag returns the lower case name of the block tag opening data,
+// along with the size of that opening tag
+func htmlBlockTag(data []byte) (string, int) {
+	i := 1
+	for i < len(data) && isalnum(data[i]) {
+		i++
+	}
+	if i >= len(data) {
+		return "", 0
+	}
+	tag := string(bytes.ToLower(data[1:i]))
+	if !blockTags[tag] {
+		return "", 0
+	}
+	if data[i] != '>' && data[i] != '/' && !isspace(data[i]) {
+		return "", 0
+	}
+
+	// the opening tag must end on its own line
+	for i < len(data) && data[i] != '>' && data[i] != '\n' {
+		i++
+	}
+	if i >= len(data) || data[i] != '>' {
+		return "", 0
+	}
+	return tag, i + 1
+}
+
+// htmlComment returns the size of a comment block, up to the end of the line
+// holding the comment end, or 0 if the comment is not closed
+func (p *parser) htmlComment(data []byte) int {
+	i := commentEnd(data)
+	if i == 0 {
+		return 0
+	}
+	return skipLine(data, i)
+}
+
+// htmlFindEnd returns the size of a block opened by tag, or 0 if the
+// matching closing tag cannot be found. Like other nested elements, the
+// tags may only nest so deeply, which also keeps the search from each
+// opening tag short.
+func (p *parser) htmlFindEnd(data []byte, tag string) int {
+	opentag := "<" + tag
+	closetag := "</" + tag + ">"
+
+	depth, i := 0, 0
+	for i < len(data) {
+		p.checkContext()
+		j := bytes.IndexByte(data[i:], '<')
+		if j < 0 {
+			return 0
+		}
+		i += j
+
+		switch {
+		case hasPrefixFold(data[i:], closetag):
+			i += len(closetag)
+			depth--
+			if depth > 0 {
+				continue
+			}
+
+			// the closing tag must end its line
+			skip := p.isEmpty(data[i:])
+			if skip == 0 {
+				return 0
+			}
+			i += skip
+			if i >= len(data) || p.flags&EXTENSION_LAX_HTML_BLOCKS != 0 {
+				return i
+			}
 
-	return i + 1
+			// and be followed by a blank line
+			if skip = p.isEmpty(data[i:]); skip == 0 {
+				return 0
+			}
+			return i + skip
+		case hasPrefixFold(data[i:], opentag):
+			i += len(opentag)
+			if i < len(data) && (data[i] == '>' || data[i] == '/' || isspace(data[i])) {
+				if depth++; depth > p.maxNesting {
+					return 0
+				}
+			}
+		default:
+			i++
+		}
+	}
+	return 0
 }
 
 func (p *parser) paragraph(out *bytes.Buffer, data []byte) int {
@@ -170,6 +576,8 @@ func (p *parser) paragraph(out *bytes.Buffer, data []byte) int {
 
 	// keep going until we find something to mark the end of the paragraph
 	for i < len(data) {
+		p.checkContext()
+
 		// mark the beginning of the current line
 		prev = line
 		current := data[i:]
@@ -186,6 +594,7 @@ func (p *parser) paragraph(out *bytes.Buffer, data []byte) int {
 			if level := p.isUnderlineHeader(current); level > 0 {
 				// reander the paragraph
 				p.renderParagraph(out, data[:prev])
+				begin := prev
 
 				// ingrore leading and trailing whitespace
 				eol := i - 1
@@ -210,18 +619,19 @@ func (p *parser) paragraph(out *bytes.Buffer, data []byte) int {
 					id = SanitizedString(string(data[prev:eol]))
 				}
 
-				p.r.Header(out, work, level, id)
-
 				// find the end of the underline
 				for data[i] != '\n' {
 					i++
 				}
+
+				p.blockSpan(data[begin:i])
+				p.r.Header(out, work, level, id)
 				return i
 			}
 		}
 
-		// if there's a prefixed header paragraph is over
-		if p.isPrefixHeader(current) {
+		// if another block starts here, paragraph is over
+		if i > 0 && p.interruptsParagraph(current) {
 			p.renderParagraph(out, data[:i])
 			return i
 		}
@@ -237,6 +647,42 @@ func (p *parser) paragraph(out *bytes.Buffer, data []byte) int {
 	return i
 }
 
+// interruptsParagraph tells whether a line starts a block that ends a
+// paragraph without a blank line in between. By default this follows
+// CommonMark: headers, horizontal rules, quotes, fenced code, html blocks and
+// lists may interrupt a paragraph, but not with an empty item, and an ordered
+// list only when it counts from one. EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK
+// lets any list, as well as indented code and tables, interrupt it too.
+func (p *parser) interruptsParagraph(data []byte) bool {
+	lax := p.flags&EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK != 0
+
+	switch {
+	case p.isPrefixHeader(data), p.isHRule(data), p.quotePrefix(data) > 0:
+		return true
+	case p.flags&EXTENSION_FENCED_CODE != 0 && p.fencedCode(nil, data, false) > 0:
+		return true
+	case htmlBlockOpens(data):
+		return true
+	case p.uliPrefix(data) > 0:
+		return lax || p.isEmpty(data[p.uliPrefix(data):]) == 0
+	case p.oliPrefix(data) > 0:
+		if lax {
+			return true
+		}
+		start := 0
+		for i := skipChar(data, 0, ' '); data[i] >= '0' && data[i] <= '9'; i++ {
+			start = start*10 + int(data[i]-'0')
+		}
+		return start == 1 && p.isEmpty(data[p.oliPrefix(data):]) == 0
+	case lax && p.codePrefix(data) > 0:
+		return true
+	case lax && p.flags&EXTENSION_TABLES != 0:
+		size, _ := p.tableHeader(nil, data, false)
+		return size > 0
+	}
+	return false
+}
+
 // renderParagraph render a single a paragraph that has already been parsed out
 func (p *parser) renderParagraph(out *bytes.Buffer, data []byte) {
 	if len(data) == 0 {
@@ -262,5 +708,836 @@ func (p *parser) renderParagraph(out *bytes.Buffer, data []byte) {
 		return true
 	}
 
+	p.span(data[begin:end])
 	p.r.Paragraph(out, work)
 }
+
+// codePrefix returns the prefix length of an indented code line, or 0. Tabs
+// are already expanded, so one indent level is a tab stop worth of spaces.
+func (p *parser) codePrefix(data []byte) int {
+	n := p.tabSize()
+	if len(data) > n && skipChar(data, 0, ' ') >= n {
+		return n
+	}
+	return 0
+}
+
+func (p *parser) code(out *bytes.Buffer, data []byte) int {
+	var work bytes.Buffer
+
+	i := 0
+	for i < len(data) {
+		p.checkContext()
+		beg := i
+		i = skipUntilChar(data, i, '\n') + 1
+
+		blankline := p.isEmpty(data[beg:i]) > 0
+		if pre := p.codePrefix(data[beg:i]); pre > 0 {
+			beg += pre
+		} else if !blankline {
+			// non-empty, non-prefixed line breaks the block
+			i = beg
+			break
+		}
+
+		// verbatim copy to the working buffer
+		if blankline {
+			work.WriteByte('\n')
+		} else {
+			work.Write(data[beg:i])
+		}
+	}
+
+	// trim all the \n off the end of work
+	workbytes := work.Bytes()
+	eol := len(workbytes)
+	for eol > 0 && workbytes[eol-1] == '\n' {
+		eol--
+	}
+	work.Truncate(eol)
+	work.WriteByte('\n')
+
+	p.blockSpan(data[:i])
+	p.r.BlockCode(out, work.Bytes(), "")
+
+	return i
+}
+
+// isFenceLine checks if there's a fence line (e.g., ``` or ~~~ go) at the
+// beginning of data, and returns the end index if so, or 0 otherwise.
+// indent is the number of leading spaces and marker the fence found.
+// If info is not nil, it gets set to the info string of an opening fence;
+// when oldmarker is set, only a closing fence for it is recognized.
+func isFenceLine(data []byte, info *string, oldmarker string) (end, indent int, marker string) {
+	i := 0
+
+	// skip up to three spaces
+	for i < len(data) && i < 3 && data[i] == ' ' {
+		i++
+	}
+	indent = i
+
+	// check for the marker characters: ~ or `
+	if i >= len(data) || (data[i] != '~' && data[i] != '`') {
+		return 0, 0, ""
+	}
+
+	c := data[i]
+	i = skipChar(data, i, c)
+
+	// the marker char must occur at least 3 times
+	if i-indent < 3 {
+		return 0, 0, ""
+	}
+	marker = string(data[indent:i])
+
+	// a closing fence uses the same char, and is at least as long
+	if oldmarker != "" && (marker[0] != oldmarker[0] || len(marker) < len(oldmarker)) {
+		return 0, 0, ""
+	}
+
+	i = skipChar(data, i, ' ')
+	infoStart := i
+	for i < len(data) && data[i] != '\n' && data[i] != '\r' {
+		// backtick fences may not contain backticks in their info string
+		if c == '`' && data[i] == '`' {
+			return 0, 0, ""
+		}
+		i++
+	}
+	infoEnd := i
+	for infoEnd > infoStart && isspace(data[infoEnd-1]) {
+		infoEnd--
+	}
+
+	// a closing fence must not have an info string
+	if oldmarker != "" && infoEnd > infoStart {
+		return 0, 0, ""
+	}
+	if info != nil {
+		*info = string(data[infoStart:infoEnd])
+	}
+
+	if i < len(data) && data[i] == '\r' {
+		i++
+	}
+	if i < len(data) && data[i] == '\n' {
+		i++
+	}
+	return i, indent, marker
+}
+
+// fencedCode returns the end index if data contains a fenced code block at
+// the beginning, or 0 otherwise. It only writes to out if doRender is true.
+// A fence that is never closed runs to the end of data.
+func (p *parser) fencedCode(out *bytes.Buffer, data []byte, doRender bool) int {
+	var info string
+	beg, indent, marker := isFenceLine(data, &info, "")
+	if beg == 0 {
+		return 0
+	}
+
+	var work bytes.Buffer
+
+	for beg < len(data) {
+		p.checkContext()
+
+		// check for the end of the code block
+		if end, _, _ := isFenceLine(data[beg:], nil, marker); end > 0 {
+			beg += end
+			break
+		}
+
+		// copy the current line, minus the indentation of the opening fence
+		end := skipUntilChar(data, beg, '\n')
+		if end < len(data) {
+			end++
+		}
+		if doRender {
+			start := beg
+			for start < beg+indent && start < end && data[start] == ' ' {
+				start++
+			}
+			work.Write(data[start:end])
+		}
+		beg = end
+	}
+
+	if doRender {
+		p.blockSpan(data[:beg])
+		p.r.BlockCode(out, work.Bytes(), info)
+	}
+
+	return beg
+}
+
+// returns block quote prefix length
+func (p *parser) quotePrefix(data []byte) int {
+	i := 0
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+	if i < len(data) && data[i] == '>' {
+		if i+1 < len(data) && data[i+1] == ' ' {
+			return i + 2
+		}
+		return i + 1
+	}
+	return 0
+}
+
+// isLazyQuoteLine tells whether a line without a quote prefix still belongs
+// to the block quote as a lazy continuation of its last paragraph, which
+// inParagraph tells is still open
+func (p *parser) isLazyQuoteLine(data []byte, inParagraph bool) bool {
+	return inParagraph && p.isEmpty(data) == 0 && !p.interruptsParagraph(data)
+}
+
+// quoteText tells whether a line of a block quote, without its prefix,
+// leaves a paragraph open, such as one of a nested quote or list item.
+// inParagraph tells whether one was open before the line.
+func (p *parser) quoteText(line []byte, inParagraph bool) bool {
+	switch {
+	case p.isEmpty(line) > 0:
+		return false
+	case inParagraph && !p.interruptsParagraph(line):
+		return true
+	case p.quotePrefix(line) > 0:
+		return p.quoteText(line[p.quotePrefix(line):], false)
+	case p.uliPrefix(line) > 0:
+		return p.quoteText(line[p.uliPrefix(line):], false)
+	case p.oliPrefix(line) > 0:
+		return p.quoteText(line[p.oliPrefix(line):], false)
+	}
+	return p.codePrefix(line) == 0 && !p.interruptsParagraph(line)
+}
+
+// parse a block quote fragment
+func (p *parser) quote(out *bytes.Buffer, data []byte) int {
+	var raw bytes.Buffer
+	var m sourceMap
+	beg, end := 0, 0
+	inParagraph := false
+	fence := "" // the marker of the fenced code block the quote is in, if any
+	for beg < len(data) {
+		p.checkContext()
+		end = skipUntilChar(data, beg, '\n') + 1
+
+		if pre := p.quotePrefix(data[beg:]); pre > 0 {
+			// skip the prefix
+			beg += pre
+		} else if !p.isLazyQuoteLine(data[beg:end], inParagraph) {
+			end = beg
+			break
+		}
+
+		// this line is part of the block quote; only paragraph text may
+		// be followed by a lazy line
+		line := data[beg:end]
+		if fence != "" {
+			if i, _, _ := isFenceLine(line, nil, fence); i > 0 {
+				fence = ""
+			}
+			inParagraph = false
+		} else if i, _, marker := isFenceLine(line, nil, ""); i > 0 && p.flags&EXTENSION_FENCED_CODE != 0 {
+			fence = marker
+			inParagraph = false
+		} else {
+			inParagraph = p.quoteText(line, inParagraph)
+		}
+		p.copied(&m, raw.Len(), line)
+		raw.Write(line)
+		beg = end
+	}
+	p.addSource(&m, raw.Bytes())
+
+	var cooked bytes.Buffer
+	p.block(&cooked, raw.Bytes())
+	p.blockSpan(data[:end])
+	p.r.BlockQuote(out, cooked.Bytes())
+	return end
+}
+
+// returns unordered list item prefix
+func (p *parser) uliPrefix(data []byte) int {
+	i := 0
+
+	// start with up to 3 spaces
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+
+	// need a *, + or - followed by a space, or ending an empty item
+	if i+1 >= len(data) || (data[i] != '*' && data[i] != '+' && data[i] != '-') {
+		return 0
+	}
+	return markerEnd(data, i+1)
+}
+
+// markerEnd returns the end of a list item marker ending at data[i]: past
+// the space following it, or at the newline of an empty item. It returns 0
+// if neither follows the marker.
+func markerEnd(data []byte, i int) int {
+	switch data[i] {
+	case ' ':
+		return i + 1
+	case '\n':
+		return i
+	}
+	return 0
+}
+
+// returns ordered list item prefix
+func (p *parser) oliPrefix(data []byte) int {
+	i := 0
+
+	// start with up to 3 spaces
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+
+	// count the digits, there may be at most nine of them
+	start := i
+	for i < len(data) && i-start < 9 && data[i] >= '0' && data[i] <= '9' {
+		i++
+	}
+
+	// we need >= 1 digits followed by a dot and a space
+	if start == i || i+1 >= len(data) || data[i] != '.' {
+		return 0
+	}
+	return markerEnd(data, i+1)
+}
+
+// returns definition list item prefix
+func (p *parser) dliPrefix(data []byte) int {
+	i := 0
+
+	// start with up to 3 spaces
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+
+	// need a : followed by a space
+	if i+1 >= len(data) || data[i] != ':' || data[i+1] != ' ' {
+		return 0
+	}
+	return i + 2
+}
+
+// dlTermEnd returns the offset of the first definition if data starts with
+// the terms of a definition list: one or more lines, possibly followed by
+// blank lines, then a definition. It returns 0 otherwise.
+func (p *parser) dlTermEnd(data []byte) int {
+	i := 0
+	for i < len(data) && p.isEmpty(data[i:]) == 0 && p.dliPrefix(data[i:]) == 0 {
+		// the term ends where a paragraph would, which also keeps the
+		// lines after it from being scanned from every block
+		if i > 0 && (p.isUnderlineHeader(data[i:]) > 0 || p.interruptsParagraph(data[i:])) {
+			return 0
+		}
+		p.checkContext()
+		i = skipUntilChar(data, i, '\n') + 1
+	}
+	if i == 0 {
+		return 0
+	}
+
+	for i < len(data) {
+		n := p.isEmpty(data[i:])
+		if n == 0 {
+			break
+		}
+		i += n
+	}
+	if i >= len(data) || p.dliPrefix(data[i:]) == 0 {
+		return 0
+	}
+	return i
+}
+
+// parse ordered, unordered or definition list block
+func (p *parser) list(out *bytes.Buffer, data []byte, flags int) int {
+	// an ordered list counts from the number of its first item
+	start := 0
+	if flags&LIST_TYPE_ORDERED != 0 {
+		for j := skipChar(data, 0, ' '); data[j] >= '0' && data[j] <= '9'; j++ {
+			start = start*10 + int(data[j]-'0')
+		}
+	}
+
+	// a first pass over the items finds the end of the list, and whether
+	// any of them makes it a loose one
+	flags |= LIST_ITEM_BEGINNING_OF_LIST
+	scan, end := flags, 0
+	for end < len(data) {
+		skip := p.listItem(nil, data[end:], &scan, false)
+		end += skip
+
+		if skip == 0 || scan&LIST_ITEM_END_OF_LIST != 0 {
+			break
+		}
+	}
+	flags |= scan & LIST_ITEM_CONTAINS_BLOCK
+
+	work := func() bool {
+		for i := 0; i < end && !p.stopped; {
+			skip := p.listItem(out, data[i:], &flags, true)
+			if skip == 0 {
+				break
+			}
+			i += skip
+			flags &= ^LIST_ITEM_BEGINNING_OF_LIST
+		}
+		return true
+	}
+
+	p.blockSpan(data[:end])
+	p.r.List(out, work, flags, start)
+	return end
+}
+
+// Parse a single list item.
+// Assumes initial prefix is already removed if this is a sublist.
+// It only renders to out if doRender is true.
+func (p *parser) listItem(out *bytes.Buffer, data []byte, flags *int, doRender bool) int {
+	var i int
+	if *flags&LIST_TYPE_DEFINITION != 0 {
+		if i = p.dliPrefix(data); i == 0 {
+			return p.definitionTerm(out, data, flags, doRender)
+		}
+		*flags &= ^LIST_TYPE_TERM
+	} else if i = p.uliPrefix(data); i == 0 {
+		i = p.oliPrefix(data)
+	}
+	if i == 0 {
+		return 0
+	}
+
+	// following lines belong to the item when indented as far as its content,
+	// unless the content starts with an indented code block
+	contentIndent := skipChar(data, i, ' ')
+	empty := data[contentIndent] == '\n'
+	if empty || contentIndent-i >= 4 {
+		contentIndent = i
+	}
+
+	// put the first line into the working buffer, unless the item starts
+	// out empty
+	var raw bytes.Buffer
+	var m sourceMap
+	line := contentIndent
+	i = skipUntilChar(data, line, '\n') + 1
+	if !empty {
+		p.copied(&m, raw.Len(), data[line:i])
+		raw.Write(data[line:i])
+	}
+	line = i
+
+	// the content of an empty item is indented one space past its marker
+	if empty && data[contentIndent-1] != ' ' {
+		contentIndent++
+	}
+
+	// offset in raw of the first nested block, if any
+	blockStart := -1
+	if !empty && (p.interruptsParagraph(raw.Bytes()) || p.codePrefix(raw.Bytes()) > 0) {
+		blockStart = 0
+	}
+
+	// the marker of the fenced code block the item is in, if any
+	fence := p.itemFence(raw.Bytes(), "")
+
+	// process the following lines
+	containsBlankLine := false
+
+gatherlines:
+	for line < len(data) {
+		p.checkContext()
+		i = skipUntilChar(data, line, '\n') + 1
+
+		// calculate the indentation, and how much of it to strip
+		indent := skipChar(data, line, ' ') - line
+		strip := indent
+		if strip > contentIndent {
+			strip = contentIndent
+		}
+		nested := indent >= contentIndent
+		blank := p.isEmpty(data[line:i]) > 0
+
+		chunk := data[line+strip : i]
+		if blank {
+			chunk = data[line:i]
+		}
+
+		// the lines of a fenced code block, blank ones included, are
+		// part of this item as long as they are indented as far as its
+		// content
+		if fence != "" && (blank || nested) {
+			fence = p.itemFence(chunk, fence)
+			p.copied(&m, raw.Len(), chunk)
+			raw.Write(chunk)
+			line = i
+			continue
+		}
+
+		// if it is an empty line, guess that it is part of this item
+		// and move on to the next line
+		if blank {
+			containsBlankLine = true
+			p.copied(&m, raw.Len(), chunk)
+			raw.Write(chunk)
+			line = i
+			continue
+		}
+
+		// a line indented by four spaces or more, but not as far as the
+		// content, starts no other item or block: it may only be lazy text
+		starts := nested || indent < 4
+
+		// evaluate how this line fits in
+		switch {
+		// is this the next definition, or the next terms, of a definition list?
+		case *flags&LIST_TYPE_DEFINITION != 0 && !nested && p.dliPrefix(chunk) > 0:
+			if containsBlankLine {
+				*flags |= LIST_ITEM_CONTAINS_BLOCK
+			}
+			break gatherlines
+
+		case *flags&LIST_TYPE_DEFINITION != 0 && !nested && containsBlankLine && p.dlTermEnd(data[line:]) > 0:
+			break gatherlines
+
+		// is this the next item of the list?
+		case *flags&LIST_TYPE_DEFINITION == 0 && !nested && starts && !p.isHRule(chunk) &&
+			(p.uliPrefix(chunk) > 0 || p.oliPrefix(chunk) > 0):
+			// end the list if the type changed
+			if (*flags&LIST_TYPE_ORDERED != 0) != (p.oliPrefix(chunk) > 0) {
+				*flags |= LIST_ITEM_END_OF_LIST
+			} else if containsBlankLine {
+				// items separated by a blank line make the list loose
+				*flags |= LIST_ITEM_CONTAINS_BLOCK
+			}
+			break gatherlines
+
+		// anything following an empty line, or opening another block, is only
+		// part of this item if it is indented as far as the item's content
+		case !nested && (containsBlankLine || (starts && p.interruptsParagraph(chunk))):
+			*flags |= LIST_ITEM_END_OF_LIST
+			break gatherlines
+
+		// is this a nested list or block?
+		case nested && (p.interruptsParagraph(chunk) || p.uliPrefix(chunk) > 0 || p.oliPrefix(chunk) > 0):
+			if containsBlankLine {
+				*flags |= LIST_ITEM_CONTAINS_BLOCK
+			}
+			if blockStart < 0 {
+				blockStart = raw.Len()
+			}
+
+		// a blank line means this should be parsed as a block
+		case containsBlankLine:
+			*flags |= LIST_ITEM_CONTAINS_BLOCK
+		}
+
+		containsBlankLine = false
+		if nested {
+			fence = p.itemFence(chunk, "")
+		}
+
+		// add the line into the working buffer without prefix
+		p.copied(&m, raw.Len(), chunk)
+		raw.Write(chunk)
+
+		line = i
+	}
+
+	// If reached end of data, this is definitely the last item in the list.
+	if line >= len(data) {
+		*flags |= LIST_ITEM_END_OF_LIST
+	}
+
+	if !doRender {
+		return line
+	}
+
+	rawBytes := raw.Bytes()
+	p.addSource(&m, rawBytes)
+
+	// render the contents of the list item
+	var cooked bytes.Buffer
+	if *flags&LIST_ITEM_CONTAINS_BLOCK != 0 {
+		// intermediate render of block item, which an empty one lacks
+		if len(rawBytes) > 0 {
+			p.block(&cooked, rawBytes)
+		}
+	} else {
+		// intermediate render of inline item, and of any nested blocks
+		text := rawBytes
+		if blockStart >= 0 {
+			text = rawBytes[:blockStart]
+		}
+		end := len(text)
+		for end > 0 && isspace(text[end-1]) {
+			end--
+		}
+		p.inline(&cooked, text[:end])
+		if blockStart >= 0 {
+			p.block(&cooked, rawBytes[blockStart:])
+		}
+	}
+
+	// render the actual list item
+	cookedBytes := cooked.Bytes()
+	parsedEnd := len(cookedBytes)
+
+	// strip trailing newlines
+	for parsedEnd > 0 && cookedBytes[parsedEnd-1] == '\n' {
+		parsedEnd--
+	}
+	p.blockSpan(data[:line])
+	p.r.ListItem(out, cookedBytes[:parsedEnd], *flags)
+
+	return line
+}
+
+// itemFence follows the fenced code blocks of a list item, given one of
+// its lines and the marker of the block the line is in, if any. It returns
+// the marker of the block the next line is in.
+func (p *parser) itemFence(line []byte, fence string) string {
+	if p.flags&EXTENSION_FENCED_CODE == 0 {
+		return ""
+	}
+	if fence != "" {
+		if end, _, _ := isFenceLine(line, nil, fence); end > 0 {
+			return ""
+		}
+		return fence
+	}
+	_, _, marker := isFenceLine(line, nil, "")
+	return marker
+}
+
+// definitionTerm parses a single line term of a definition list, along with
+// any blank lines separating it from its definition
+func (p *parser) definitionTerm(out *bytes.Buffer, data []byte, flags *int, doRender bool) int {
+	*flags |= LIST_TYPE_TERM
+
+	end := skipUntilChar(data, 0, '\n') + 1
+	if doRender {
+		begin := skipChar(data, 0, ' ')
+		eol := end - 1
+		for eol > begin && isspace(data[eol-1]) {
+			eol--
+		}
+
+		var cooked bytes.Buffer
+		p.inline(&cooked, data[begin:eol])
+		p.span(data[begin:eol])
+		p.r.ListItem(out, cooked.Bytes(), *flags)
+	}
+
+	// a blank line before a definition makes the list loose
+	for end < len(data) {
+		n := p.isEmpty(data[end:])
+		if n == 0 {
+			break
+		}
+		*flags |= LIST_ITEM_CONTAINS_BLOCK
+		end += n
+	}
+	return end
+}
+
+func (p *parser) table(out *bytes.Buffer, data []byte) int {
+	var header bytes.Buffer
+	i, columns := p.tableHeader(&header, data, true)
+	if i == 0 {
+		return 0
+	}
+
+	var body bytes.Buffer
+
+	for i < len(data) && !p.stopped {
+		p.checkContext()
+		pipes, rowStart := 0, i
+		for ; data[i] != '\n'; i++ {
+			if data[i] == '|' {
+				pipes++
+			}
+		}
+
+		// a row without any pipe ends the table
+		if pipes == 0 {
+			i = rowStart
+			break
+		}
+
+		// include the newline in data sent to tableRow
+		i++
+		p.tableRow(&body, data[rowStart:i], columns, false)
+	}
+
+	p.blockSpan(data[:i])
+	p.r.Table(out, header.Bytes(), body.Bytes(), columns)
+
+	return i
+}
+
+// tableHeader parses the header and delimiter rows of a table. It only
+// renders the header to out if doRender is true.
+func (p *parser) tableHeader(out *bytes.Buffer, data []byte, doRender bool) (size int, columns []int) {
+	i := 0
+	colCount := 1
+	if bytes.IndexByte(data, '\n') < 0 {
+		return
+	}
+	for i = 0; data[i] != '\n'; i++ {
+		if data[i] == '|' && !isBackslashEscaped(data, i) {
+			colCount++
+		}
+	}
+
+	// doesn't look like a table header
+	if colCount == 1 {
+		return
+	}
+
+	// include the newline in the data sent to tableRow
+	header := data[:i+1]
+
+	// column count ignores pipes at beginning or end of line
+	if data[0] == '|' {
+		colCount--
+	}
+	if i > 2 && data[i-1] == '|' && !isBackslashEscaped(data, i-1) {
+		colCount--
+	}
+
+	columns = make([]int, colCount)
+
+	// move on to the header underline, which has to end with a newline too
+	i++
+	if bytes.IndexByte(data[i:], '\n') < 0 {
+		return
+	}
+
+	if data[i] == '|' && !isBackslashEscaped(data, i) {
+		i++
+	}
+	i = skipChar(data, i, ' ')
+
+	// each column header is of form: / *:?-+:? *|/ with # dashes + # colons >= 3
+	// and trailing | optional on last column
+	col := 0
+	for data[i] != '\n' {
+		dashes := 0
+
+		if data[i] == ':' {
+			i++
+			columns[col] |= TABLE_ALIGNMENT_LEFT
+			dashes++
+		}
+		for data[i] == '-' {
+			i++
+			dashes++
+		}
+		if data[i] == ':' {
+			i++
+			columns[col] |= TABLE_ALIGNMENT_RIGHT
+			dashes++
+		}
+		i = skipChar(data, i, ' ')
+
+		// end of column test is messy
+		switch {
+		case dashes < 3:
+			// not a valid column
+			return
+
+		case data[i] == '|' && !isBackslashEscaped(data, i):
+			// marker found, now skip past trailing whitespace
+			col++
+			i = skipChar(data, i+1, ' ')
+
+			// trailing junk found after last column
+			if col >= colCount && data[i] != '\n' {
+				return
+			}
+
+		case (data[i] != '|' || isBackslashEscaped(data, i)) && col+1 < colCount:
+			// something else found where marker was required
+			return
+
+		case data[i] == '\n':
+			// marker is optional for the last column
+			col++
+
+		default:
+			// trailing junk found after last column
+			return
+		}
+	}
+	if col != colCount {
+		return
+	}
+
+	if doRender {
+		p.tableRow(out, header, columns, true)
+	}
+	size = i + 1
+	return
+}
+
+func (p *parser) tableRow(out *bytes.Buffer, data []byte, columns []int, header bool) {
+	i, col := 0, 0
+	var rowWork bytes.Buffer
+
+	if data[i] == '|' && !isBackslashEscaped(data, i) {
+		i++
+	}
+
+	for col = 0; col < len(columns) && i < len(data); col++ {
+		i = skipChar(data, i, ' ')
+
+		cellStart := i
+
+		for (data[i] != '|' || isBackslashEscaped(data, i)) && data[i] != '\n' {
+			i++
+		}
+
+		cellEnd := i
+
+		// skip the end-of-cell marker, possibly taking us past end of buffer
+		i++
+
+		for cellEnd > cellStart && data[cellEnd-1] == ' ' {
+			cellEnd--
+		}
+
+		var cellWork bytes.Buffer
+		p.inline(&cellWork, data[cellStart:cellEnd])
+
+		p.span(data[cellStart:cellEnd])
+		if header {
+			p.r.TableHeaderCell(&rowWork, cellWork.Bytes(), columns[col])
+		} else {
+			p.r.TableCell(&rowWork, cellWork.Bytes(), columns[col])
+		}
+	}
+
+	// pad it out with empty columns to get the right number
+	rowEnd := len(data) - 1
+	for ; col < len(columns); col++ {
+		p.span(data[rowEnd:rowEnd])
+		if header {
+			p.r.TableHeaderCell(&rowWork, nil, columns[col])
+		} else {
+			p.r.TableCell(&rowWork, nil, columns[col])
+		}
+	}
+
+	// silently ignore rows with too many cells
+
+	p.blockSpan(data)
+	p.r.TableRow(out, rowWork.Bytes())
+}
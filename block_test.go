@@ -8,6 +8,7 @@
 package markdown
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"testing"
 )
@@ -223,6 +224,9 @@ func TestPrefixHeaderIdExtension(t *testing.T) {
 
 		"Hello\n# Header 1\nGoodbye\n",
 		"<p>Hello</p>\n\n<h1>Header 1</h1>\n\n<p>Goodbye</p>\n",
+
+		"# Header 1 {#a\"<b>}\n",
+		"<h1 id=\"a&quot;&lt;b&gt;\">Header 1</h1>\n",
 	}
 	doTestsBlock(t, tests, EXTENSION_HEADER_IDS)
 }
@@ -453,6 +457,65 @@ func TestUnderlineHeadersAutoIDs(t *testing.T) {
 	doTestsBlock(t, tests, EXTENSION_AUTO_HEADER_IDS)
 }
 
+func TestHorizontalRule(t *testing.T) {
+	var tests = []string{
+		"-\n",
+		"<ul>\n<li></li>\n</ul>\n",
+
+		"--\n",
+		"<p>--</p>\n",
+
+		"---\n",
+		"<hr />\n",
+
+		"----\n",
+		"<hr />\n",
+
+		"*\n",
+		"<ul>\n<li></li>\n</ul>\n",
+
+		"**\n",
+		"<p>**</p>\n",
+
+		"***\n",
+		"<hr />\n",
+
+		"___\n",
+		"<hr />\n",
+
+		"* * *\n",
+		"<hr />\n",
+
+		"   - - -  \n",
+		"<hr />\n",
+
+		"-*-\n",
+		"<p>-*-</p>\n",
+
+		"Hello\n***\n",
+		"<p>Hello</p>\n\n<hr />\n",
+
+		"Hello\n- - -\n",
+		"<p>Hello</p>\n\n<hr />\n",
+
+		"Setext header\n---\n",
+		"<h2>Setext header</h2>\n",
+
+		"* Item\n* * *\n* Item\n",
+		"<ul>\n<li>Item</li>\n</ul>\n\n<hr />\n\n<ul>\n<li>Item</li>\n</ul>\n",
+	}
+	doTestsBlock(t, tests, 0)
+
+	// without HTML_USE_XHTML the rule is not self-closing
+	tests = []string{
+		"***\n",
+		"<hr>\n",
+	}
+	doTestsBlockWithRunner(t, tests, 0, func(input string, extensions int) string {
+		return runMarkdownBlockWithRenderer(input, extensions, HtmlRenderer(0, "", ""))
+	})
+}
+
 //
 //
 // Unit TestCases
@@ -505,3 +568,595 @@ func TestIsEmpty(t *testing.T) {
 		assert.Equal(p.isEmpty([]byte(key)), value)
 	}
 }
+
+func TestTable(t *testing.T) {
+	var tests = []string{
+		"a | b\n---|---\nc | d\n",
+		"<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>c</td>\n<td>d</td>\n</tr>\n</tbody>\n</table>\n",
+
+		"a | b\n---|--\nc | d\n",
+		"<p>a | b\n---|--\nc | d</p>\n",
+
+		"|a|b|c|d|\n|----|----|----|---|\n|e|f|g|h|\n",
+		"<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n<th>c</th>\n<th>d</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>e</td>\n<td>f</td>\n<td>g</td>\n<td>h</td>\n</tr>\n</tbody>\n</table>\n",
+
+		"*a*|__b__|[c](C)|d\n---|---|---|---\ne|f|g|h\n",
+		"<table>\n<thead>\n<tr>\n<th><em>a</em></th>\n<th><strong>b</strong></th>\n<th><a href=\"C\">c</a></th>\n<th>d</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>e</td>\n<td>f</td>\n<td>g</td>\n<td>h</td>\n</tr>\n</tbody>\n</table>\n",
+
+		"a|b|c\n---|---|---\nd|e|f\ng|h\ni|j|k|l|m\nn|o|p\n",
+		"<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n<th>c</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>d</td>\n<td>e</td>\n<td>f</td>\n</tr>\n\n" +
+			"<tr>\n<td>g</td>\n<td>h</td>\n<td></td>\n</tr>\n\n" +
+			"<tr>\n<td>i</td>\n<td>j</td>\n<td>k</td>\n</tr>\n\n" +
+			"<tr>\n<td>n</td>\n<td>o</td>\n<td>p</td>\n</tr>\n</tbody>\n</table>\n",
+
+		"a|b|c\n---|:---|---:\nd|e|f\n",
+		"<table>\n<thead>\n<tr>\n<th>a</th>\n<th align=\"left\">b</th>\n<th align=\"right\">c</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>d</td>\n<td align=\"left\">e</td>\n<td align=\"right\">f</td>\n</tr>\n</tbody>\n</table>\n",
+
+		"a|b|c\n---|:---:|---:\nd|e|f\n",
+		"<table>\n<thead>\n<tr>\n<th>a</th>\n<th align=\"center\">b</th>\n<th align=\"right\">c</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>d</td>\n<td align=\"center\">e</td>\n<td align=\"right\">f</td>\n</tr>\n</tbody>\n</table>\n",
+
+		"a|b|c\n---|:---:|---:|---\nd|e|f\n",
+		"<p>a|b|c\n---|:---:|---:|---\nd|e|f</p>\n",
+
+		"a|b|c|d\n----|----|----|---|\ne|f|g|h\n",
+		"<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n<th>c</th>\n<th>d</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>e</td>\n<td>f</td>\n<td>g</td>\n<td>h</td>\n</tr>\n</tbody>\n</table>\n",
+
+		"a \\| b|c\n---|---\nd|e \\| f\n",
+		"<table>\n<thead>\n<tr>\n<th>a | b</th>\n<th>c</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>d</td>\n<td>e | f</td>\n</tr>\n</tbody>\n</table>\n",
+
+		"a | b\n---|---\nc | d\nnot a row\n",
+		"<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>c</td>\n<td>d</td>\n</tr>\n</tbody>\n</table>\n\n<p>not a row</p>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_TABLES)
+}
+
+func TestFencedCodeBlock(t *testing.T) {
+	var tests = []string{
+		"``` go\nfunc foo() bool {\n\treturn true;\n}\n```\n",
+		"<pre><code class=\"language-go\">func foo() bool {\n\treturn true;\n}\n</code></pre>\n",
+
+		"``` c\n/* special & char < > \" escaping */\n```\n",
+		"<pre><code class=\"language-c\">/* special &amp; char &lt; &gt; &quot; escaping */\n</code></pre>\n",
+
+		"```\nno language\n```\n",
+		"<pre><code>no language\n</code></pre>\n",
+
+		"~~~ python extra words\ntildes\n~~~\n",
+		"<pre><code class=\"language-python\">tildes\n</code></pre>\n",
+
+		"````\nlonger fence\n```\nstill code\n`````\n",
+		"<pre><code>longer fence\n```\nstill code\n</code></pre>\n",
+
+		"~~~\nmixed markers\n```\n~~~\n",
+		"<pre><code>mixed markers\n```\n</code></pre>\n",
+
+		"``\nnot a fence\n``\n",
+		"<p><code>\nnot a fence\n</code></p>\n",
+
+		"Some text before a fence\n```\ncode\n```\nand after\n",
+		"<p>Some text before a fence</p>\n\n<pre><code>code\n</code></pre>\n\n<p>and after</p>\n",
+
+		"  ```\n  indented\n   fence\nbody\n  ```\n",
+		"<pre><code>indented\n fence\nbody\n</code></pre>\n",
+
+		"```\nnever closed\n\nstill code\n",
+		"<pre><code>never closed\n\nstill code\n</code></pre>\n",
+
+		"```\n\n\tblank lines and tabs\n\n```\n",
+		"<pre><code>\n\tblank lines and tabs\n\n</code></pre>\n",
+
+		"```\r\nwindows\r\nline endings\r\n```\r\n",
+		"<pre><code>windows\nline endings\n</code></pre>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_FENCED_CODE)
+}
+
+func TestIndentedCodeBlock(t *testing.T) {
+	var tests = []string{
+		"    func foo() bool {\n        return true;\n    }\n",
+		"<pre><code>func foo() bool {\n    return true;\n}\n</code></pre>\n",
+
+		"\tfunc foo() bool {\n\t\treturn true;\n\t}\n",
+		"<pre><code>func foo() bool {\n    return true;\n}\n</code></pre>\n",
+
+		"    /* special & char < > \" escaping */\n",
+		"<pre><code>/* special &amp; char &lt; &gt; &quot; escaping */\n</code></pre>\n",
+
+		"    code with\n\n\n    blank lines\n\n\nParagraph\n",
+		"<pre><code>code with\n\n\nblank lines\n</code></pre>\n\n<p>Paragraph</p>\n",
+
+		"Paragraph\n    lazy continuation\n",
+		"<p>Paragraph\n    lazy continuation</p>\n",
+
+		"   three spaces\n",
+		"<p>three spaces</p>\n",
+
+		"    # not a header\n",
+		"<pre><code># not a header\n</code></pre>\n",
+	}
+	doTestsBlock(t, tests, 0)
+
+	// one indent level is a full tab stop
+	tests = []string{
+		"\tfunc foo() bool {\n\t\treturn true;\n\t}\n",
+		"<pre><code>func foo() bool {\n        return true;\n}\n</code></pre>\n",
+
+		"    four spaces\n",
+		"<p>four spaces</p>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_TAB_SIZE_EIGHT)
+}
+
+func TestBlockQuote(t *testing.T) {
+	var tests = []string{
+		"> A quote\n",
+		"<blockquote>\n<p>A quote</p>\n</blockquote>\n",
+
+		">A quote without a space\n",
+		"<blockquote>\n<p>A quote without a space</p>\n</blockquote>\n",
+
+		"> A quote\nwith a lazy line\n\nParagraph\n",
+		"<blockquote>\n<p>A quote\nwith a lazy line</p>\n</blockquote>\n\n<p>Paragraph</p>\n",
+
+		"> # Header\n> text\n",
+		"<blockquote>\n<h1>Header</h1>\n\n<p>text</p>\n</blockquote>\n",
+
+		"> Two\n>\n> paragraphs\n",
+		"<blockquote>\n<p>Two</p>\n\n<p>paragraphs</p>\n</blockquote>\n",
+
+		"> Two\n\n> quotes\n",
+		"<blockquote>\n<p>Two</p>\n</blockquote>\n\n<blockquote>\n<p>quotes</p>\n</blockquote>\n",
+
+		"Paragraph\n> quote\n",
+		"<p>Paragraph</p>\n\n<blockquote>\n<p>quote</p>\n</blockquote>\n",
+
+		">     code\n",
+		"<blockquote>\n<pre><code>code\n</code></pre>\n</blockquote>\n",
+
+		"> > nested\n> > quote\nlazy\n",
+		"<blockquote>\n<blockquote>\n<p>nested\nquote\nlazy</p>\n</blockquote>\n</blockquote>\n",
+
+		"> quote\n# header\n",
+		"<blockquote>\n<p>quote</p>\n</blockquote>\n\n<h1>header</h1>\n",
+
+		"> quote\n```\ncode\n```\n",
+		"<blockquote>\n<p>quote</p>\n</blockquote>\n\n<pre><code>code\n</code></pre>\n",
+
+		"> ```\n> code\n> ```\n",
+		"<blockquote>\n<pre><code>code\n</code></pre>\n</blockquote>\n",
+
+		">     code\nlazy\n",
+		"<blockquote>\n<pre><code>code\n</code></pre>\n</blockquote>\n\n<p>lazy</p>\n",
+
+		"> ```\n> code\nlazy\n",
+		"<blockquote>\n<pre><code>code\n</code></pre>\n</blockquote>\n\n<p>lazy</p>\n",
+
+		"> # Header\nlazy\n",
+		"<blockquote>\n<h1>Header</h1>\n</blockquote>\n\n<p>lazy</p>\n",
+
+		"> - item\nlazy\n",
+		"<blockquote>\n<ul>\n<li>item\nlazy</li>\n</ul>\n</blockquote>\n",
+
+		"> text\n>     more\nlazy\n",
+		"<blockquote>\n<p>text\n    more\nlazy</p>\n</blockquote>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_FENCED_CODE)
+}
+
+func TestUnorderedList(t *testing.T) {
+	var tests = []string{
+		"* Hello\n",
+		"<ul>\n<li>Hello</li>\n</ul>\n",
+
+		"* Yin\n* Yang\n",
+		"<ul>\n<li>Yin</li>\n<li>Yang</li>\n</ul>\n",
+
+		"+ Yin\n+ Yang\n",
+		"<ul>\n<li>Yin</li>\n<li>Yang</li>\n</ul>\n",
+
+		"- Yin\n- Yang\n",
+		"<ul>\n<li>Yin</li>\n<li>Yang</li>\n</ul>\n",
+
+		"* Yin\n\n* Yang\n",
+		"<ul>\n<li><p>Yin</p></li>\n\n<li><p>Yang</p></li>\n</ul>\n",
+
+		"* Ting\n* Bong\n\n* Goo\n",
+		"<ul>\n<li><p>Ting</p></li>\n\n<li><p>Bong</p></li>\n\n<li><p>Goo</p></li>\n</ul>\n",
+
+		"* Item\n\n  Second paragraph\n* Next\n",
+		"<ul>\n<li><p>Item</p>\n\n<p>Second paragraph</p></li>\n\n<li><p>Next</p></li>\n</ul>\n",
+
+		"* Hello\nlazy continuation\n* World\n",
+		"<ul>\n<li>Hello\nlazy continuation</li>\n<li>World</li>\n</ul>\n",
+
+		"* List\n\nParagraph\n",
+		"<ul>\n<li>List</li>\n</ul>\n\n<p>Paragraph</p>\n",
+
+		"Paragraph\n* List\n",
+		"<p>Paragraph</p>\n\n<ul>\n<li>List</li>\n</ul>\n",
+
+		"* List\n# Header\n",
+		"<ul>\n<li>List</li>\n</ul>\n\n<h1>Header</h1>\n",
+
+		"* # Header\n* > Quote\n",
+		"<ul>\n<li><h1>Header</h1></li>\n<li><blockquote>\n<p>Quote</p>\n</blockquote></li>\n</ul>\n",
+
+		"* List\n  > nested quote\n* Next\n",
+		"<ul>\n<li>List\n<blockquote>\n<p>nested quote</p>\n</blockquote></li>\n<li>Next</li>\n</ul>\n",
+
+		"*Not a list*\n",
+		"<p><em>Not a list</em></p>\n",
+
+		"-     code\n",
+		"<ul>\n<li><pre><code>code\n</code></pre></li>\n</ul>\n",
+
+		"-\n",
+		"<ul>\n<li></li>\n</ul>\n",
+
+		"- one\n-\n- three\n",
+		"<ul>\n<li>one</li>\n<li></li>\n<li>three</li>\n</ul>\n",
+
+		"-\n  foo\n",
+		"<ul>\n<li>foo</li>\n</ul>\n",
+
+		"- one\n\n-\n",
+		"<ul>\n<li><p>one</p></li>\n\n<li></li>\n</ul>\n",
+
+		"- a\n - b\n  - c\n   - d\n    - e\n",
+		"<ul>\n<li>a</li>\n<li>b</li>\n<li>c</li>\n<li>d\n- e</li>\n</ul>\n",
+	}
+	doTestsBlock(t, tests, 0)
+}
+
+func TestOrderedList(t *testing.T) {
+	var tests = []string{
+		"1. Hello\n",
+		"<ol>\n<li>Hello</li>\n</ol>\n",
+
+		"1. Yin\n2. Yang\n",
+		"<ol>\n<li>Yin</li>\n<li>Yang</li>\n</ol>\n",
+
+		"1. Yin\n\n2. Yang\n",
+		"<ol>\n<li><p>Yin</p></li>\n\n<li><p>Yang</p></li>\n</ol>\n",
+
+		"3. Three\n4. Four\n",
+		"<ol start=\"3\">\n<li>Three</li>\n<li>Four</li>\n</ol>\n",
+
+		"0. Zero\n",
+		"<ol start=\"0\">\n<li>Zero</li>\n</ol>\n",
+
+		"1234567890. too many digits\n",
+		"<p>1234567890. too many digits</p>\n",
+
+		"1. Ordered\n- Unordered\n",
+		"<ol>\n<li>Ordered</li>\n</ol>\n\n<ul>\n<li>Unordered</li>\n</ul>\n",
+
+		"Paragraph\n1. List\n",
+		"<p>Paragraph</p>\n\n<ol>\n<li>List</li>\n</ol>\n",
+
+		"Paragraph\n2. not a list\n",
+		"<p>Paragraph\n2. not a list</p>\n",
+
+		"1. Item\n\n   ```\n   code\n   ```\n2. Next\n",
+		"<ol>\n<li><p>Item</p>\n\n<pre><code>code\n</code></pre></li>\n\n<li><p>Next</p></li>\n</ol>\n",
+
+		"1.\n2. Two\n",
+		"<ol>\n<li></li>\n<li>Two</li>\n</ol>\n",
+
+		"1. Item\n   ```\n   one\n\n   two\n   ```\n2. Next\n",
+		"<ol>\n<li>Item\n<pre><code>one\n\ntwo\n</code></pre></li>\n<li>Next</li>\n</ol>\n",
+
+		"1. ```\n   one\n\n   two\n   ```\n2. Next\n",
+		"<ol>\n<li><pre><code>one\n\ntwo\n</code></pre></li>\n<li>Next</li>\n</ol>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_FENCED_CODE)
+}
+
+func TestNestedList(t *testing.T) {
+	var tests = []string{
+		"* Outer\n  * Inner\n    * Innermost\n* Next\n",
+		"<ul>\n<li>Outer\n<ul>\n<li>Inner\n<ul>\n<li>Innermost</li>\n</ul></li>\n</ul></li>\n<li>Next</li>\n</ul>\n",
+
+		"1. Outer\n   - Inner\n   - Inner\n2. Next\n",
+		"<ol>\n<li>Outer\n<ul>\n<li>Inner</li>\n<li>Inner</li>\n</ul></li>\n<li>Next</li>\n</ol>\n",
+
+		"* Outer\n\n  * Inner\n* Next\n",
+		"<ul>\n<li><p>Outer</p>\n\n<ul>\n<li>Inner</li>\n</ul></li>\n\n<li><p>Next</p></li>\n</ul>\n",
+
+		"- Outer\n  3. Inner\n",
+		"<ul>\n<li>Outer\n<ol start=\"3\">\n<li>Inner</li>\n</ol></li>\n</ul>\n",
+	}
+	doTestsBlock(t, tests, 0)
+}
+
+func TestHtmlBlock(t *testing.T) {
+	var tests = []string{
+		"<div>\nfoo *bar*\n</div>\n\npara\n",
+		"<div>\nfoo *bar*\n</div>\n\n<p>para</p>\n",
+
+		"<DIV class=\"x\">\n<div>\ninner\n</div>\n</div>\n\nafter\n",
+		"<DIV class=\"x\">\n<div>\ninner\n</div>\n</div>\n\n<p>after</p>\n",
+
+		"<details>\n<summary>More</summary>\n\n*hidden*\n</details>\n",
+		"<details>\n<summary>More</summary>\n\n*hidden*\n</details>\n",
+
+		"<!-- a comment\nover two lines -->\n\npara\n",
+		"<!-- a comment\nover two lines -->\n\n<p>para</p>\n",
+
+		"<hr>\n<hr />\ntext\n",
+		"<hr>\n\n<hr />\n\n<p>text</p>\n",
+
+		// the closing tag must be followed by a blank line
+		"<div>\nfoo\n</div>\npara\n",
+		"<p><div>\nfoo\n</div>\npara</p>\n",
+
+		// only block tags open a block
+		"<span>\nfoo\n</span>\n",
+		"<p><span>\nfoo\n</span></p>\n",
+
+		"    <div>\n    code\n    </div>\n",
+		"<pre><code>&lt;div&gt;\ncode\n&lt;/div&gt;\n</code></pre>\n",
+
+		"<div>\xc9\xc9\xc9</div>\n",
+		"<div>\xc9\xc9\xc9</div>\n",
+
+		"<Div>\nmixed case\n</dIV>\n",
+		"<Div>\nmixed case\n</dIV>\n",
+	}
+	doTestsBlock(t, tests, 0)
+}
+
+func TestHtmlBlockLax(t *testing.T) {
+	var tests = []string{
+		"<div>\nfoo\n</div>\npara\n",
+		"<div>\nfoo\n</div>\n\n<p>para</p>\n",
+
+		"<div>\nunclosed\n\npara\n",
+		"<div>\nunclosed\n\n<p>para</p>\n",
+
+		"<!-- unclosed\n\npara\n",
+		"<!-- unclosed\n\n<p>para</p>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_LAX_HTML_BLOCKS)
+}
+
+func TestHtmlBlockSkipFlags(t *testing.T) {
+	runner := func(flags int) func(string, int) string {
+		return func(input string, extensions int) string {
+			return runMarkdownBlockWithRenderer(input, extensions, HtmlRenderer(flags, "", ""))
+		}
+	}
+
+	var tests = []string{
+		"<div>\nx\n</div>\n\npara\n",
+		"<p>para</p>\n",
+	}
+	doTestsBlockWithRunner(t, tests, 0, runner(HTML_SKIP_HTML))
+
+	tests = []string{
+		"<div><img src=\"a.png\"><style>\nb{}\n</style><a href=\"x\">y</a></div>\n",
+		"<div>y</div>\n",
+
+		"<style>\np {}\n</style>\n\npara\n",
+		"<p>para</p>\n",
+	}
+	doTestsBlockWithRunner(t, tests, 0, runner(HTML_SKIP_STYLE|HTML_SKIP_LINKS|HTML_SKIP_IMAGES))
+}
+
+func TestTOC(t *testing.T) {
+	runner := func(flags int) func(string, int) string {
+		return func(input string, extensions int) string {
+			return runMarkdownBlockWithRenderer(input, extensions, HtmlRenderer(flags, "", ""))
+		}
+	}
+
+	var tests = []string{
+		"# Title\n\nintro\n\n## One [link](/x)\n\n### Deep\n\n## Two\n\n# Other\n",
+		"<nav>\n<ul>\n<li><a href=\"#toc_0\">Title</a>\n" +
+			"<ul>\n<li><a href=\"#toc_1\">One link</a>\n" +
+			"<ul>\n<li><a href=\"#toc_2\">Deep</a></li>\n</ul></li>\n" +
+			"<li><a href=\"#toc_3\">Two</a></li>\n</ul></li>\n" +
+			"<li><a href=\"#toc_4\">Other</a></li>\n</ul>\n</nav>\n\n" +
+			"<h1 id=\"toc_0\">Title</h1>\n\n<p>intro</p>\n\n" +
+			"<h2 id=\"toc_1\">One <a href=\"/x\">link</a></h2>\n\n" +
+			"<h3 id=\"toc_2\">Deep</h3>\n\n<h2 id=\"toc_3\">Two</h2>\n\n<h1 id=\"toc_4\">Other</h1>\n",
+
+		"### Deep\n\n# Top\n",
+		"<nav>\n<ul>\n<li>\n<ul>\n<li>\n<ul>\n<li><a href=\"#toc_0\">Deep</a></li>\n</ul></li>\n</ul></li>\n" +
+			"<li><a href=\"#toc_1\">Top</a></li>\n</ul>\n</nav>\n\n" +
+			"<h3 id=\"toc_0\">Deep</h3>\n\n<h1 id=\"toc_1\">Top</h1>\n",
+
+		"no headers\n",
+		"<p>no headers</p>\n",
+	}
+	doTestsBlockWithRunner(t, tests, 0, runner(HTML_TOC))
+
+	tests = []string{
+		"# A {#custom}\n\n# B\n",
+		"<nav>\n<ul>\n<li><a href=\"#custom\">A</a></li>\n<li><a href=\"#toc_1\">B</a></li>\n</ul>\n</nav>\n\n" +
+			"<h1 id=\"custom\">A</h1>\n\n<h1 id=\"toc_1\">B</h1>\n",
+
+		// the link and the header it points at escape the id alike
+		"# A {#a\"<b>&}\n",
+		"<nav>\n<ul>\n<li><a href=\"#a&quot;&lt;b&gt;&amp;\">A</a></li>\n</ul>\n</nav>\n\n" +
+			"<h1 id=\"a&quot;&lt;b&gt;&amp;\">A</h1>\n",
+	}
+	doTestsBlockWithRunner(t, tests, EXTENSION_HEADER_IDS, runner(HTML_TOC))
+
+	tests = []string{
+		"# Title\n\nintro\n\n## Section\n\ntext\n",
+		"<nav>\n<ul>\n<li><a href=\"#toc_0\">Title</a>\n" +
+			"<ul>\n<li><a href=\"#toc_1\">Section</a></li>\n</ul></li>\n</ul>\n</nav>\n",
+
+		"no headers\n",
+		"",
+	}
+	doTestsBlockWithRunner(t, tests, 0, runner(HTML_TOC|HTML_OMIT_CONTENTS))
+}
+
+func TestDefinitionList(t *testing.T) {
+	var tests = []string{
+		"Term 1\n: Definition a\n: Definition b\n\nTerm 2\n: Definition c\n",
+		"<dl>\n<dt>Term 1</dt>\n<dd>Definition a</dd>\n<dd>Definition b</dd>\n" +
+			"<dt>Term 2</dt>\n<dd>Definition c</dd>\n</dl>\n",
+
+		"Apple\nApfel\n:   A *fruit*\n    continued\nlazy line\n\nafter\n",
+		"<dl>\n<dt>Apple</dt>\n<dt>Apfel</dt>\n<dd>A <em>fruit</em>\ncontinued\nlazy line</dd>\n</dl>\n\n<p>after</p>\n",
+
+		"Head\n===\nTerm\n: def\n",
+		"<h1>Head</h1>\n\n<dl>\n<dt>Term</dt>\n<dd>def</dd>\n</dl>\n",
+
+		"Term\n\n:   First para.\n\n    Second para.\n\n:   Another\n",
+		"<dl>\n<dt>Term</dt>\n<dd><p>First para.</p>\n\n<p>Second para.</p></dd>\n<dd><p>Another</p></dd>\n</dl>\n",
+
+		"Term\n:   Def with list:\n\n    * one\n    * two\n\n    > quote\n",
+		"<dl>\n<dt>Term</dt>\n<dd><p>Def with list:</p>\n\n<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n\n" +
+			"<blockquote>\n<p>quote</p>\n</blockquote></dd>\n</dl>\n",
+
+		"Term\n: def\n* list after\n",
+		"<dl>\n<dt>Term</dt>\n<dd>def</dd>\n</dl>\n\n<ul>\n<li>list after</li>\n</ul>\n",
+
+		"# Header\n: not a definition\n",
+		"<h1>Header</h1>\n\n<p>: not a definition</p>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_DEFINITION_LISTS)
+
+	tests = []string{
+		"Term\n: def\n",
+		"<p>Term\n: def</p>\n",
+	}
+	doTestsBlock(t, tests, 0)
+}
+
+func TestTitleBlock(t *testing.T) {
+	var tests = []string{
+		"% My Title\n% Jane Doe; John Roe\n% 2016-05-01\n\nBody text.\n",
+		"<h1 class=\"title\">My Title</h1>\n\n<p class=\"author\">Jane Doe; John Roe</p>\n\n" +
+			"<p class=\"date\">2016-05-01</p>\n\n<p>Body text.</p>\n",
+
+		"% A long\n  title & more\n%\n% June\nBody\n",
+		"<h1 class=\"title\">A long title &amp; more</h1>\n\n<p class=\"date\">June</p>\n\n<p>Body</p>\n",
+
+		"% Only\n",
+		"<h1 class=\"title\">Only</h1>\n",
+
+		"Intro\n\n% not a title\n",
+		"<p>Intro</p>\n\n<p>% not a title</p>\n",
+
+		"%d of them\n",
+		"<p>%d of them</p>\n",
+
+		"% Title\n%d\n",
+		"<h1 class=\"title\">Title</h1>\n\n<p>%d</p>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_TITLEBLOCK)
+
+	tests = []string{
+		"% My Title\n",
+		"<p>% My Title</p>\n",
+	}
+	doTestsBlock(t, tests, 0)
+
+	page := func(title string) func(string, int) string {
+		return func(input string, extensions int) string {
+			return runMarkdownBlockWithRenderer(input, extensions, HtmlRenderer(HTML_COMPLETE_PAGE, title, ""))
+		}
+	}
+	header := "<!DOCTYPE html>\n<html>\n<head>\n  <title>%s</title>\n" +
+		"  <meta name=\"GENERATOR\" content=\"Markdown Processor v" + VERSION + "\">\n" +
+		"  <meta charset=\"utf-8\">\n</head>\n<body>\n"
+	footer := "\n</body>\n</html>\n"
+
+	tests = []string{
+		"% My Title\n\nBody\n",
+		fmt.Sprintf(header, "My Title") + "<h1 class=\"title\">My Title</h1>\n\n<p>Body</p>\n" + footer,
+	}
+	doTestsBlockWithRunner(t, tests, EXTENSION_TITLEBLOCK, page(""))
+
+	tests = []string{
+		"% My Title\n\nBody\n",
+		fmt.Sprintf(header, "Given") + "<h1 class=\"title\">My Title</h1>\n\n<p>Body</p>\n" + footer,
+	}
+	doTestsBlockWithRunner(t, tests, EXTENSION_TITLEBLOCK, page("Given"))
+
+	// the title of one document is not carried over to the next
+	renderer := HtmlRenderer(HTML_COMPLETE_PAGE, "", "")
+	runMarkdownBlockWithRenderer("% First\n", EXTENSION_TITLEBLOCK, renderer)
+	expected := fmt.Sprintf(header, "") + "\n<p>Second</p>\n" + footer
+	if actual := runMarkdownBlockWithRenderer("Second\n", EXTENSION_TITLEBLOCK, renderer); actual != expected {
+		t.Errorf("\nExpected[%#v]\nActual	[%#v]", expected, actual)
+	}
+}
+
+func TestParagraphInterruption(t *testing.T) {
+	// blocks that may always interrupt a paragraph
+	var tests = []string{
+		"para\n# head\n",
+		"<p>para</p>\n\n<h1>head</h1>\n",
+
+		"para\n> quote\n",
+		"<p>para</p>\n\n<blockquote>\n<p>quote</p>\n</blockquote>\n",
+
+		"para\n```\ncode\n```\n",
+		"<p>para</p>\n\n<pre><code>code\n</code></pre>\n",
+
+		"para\n<div>\nx\n</div>\n\nafter\n",
+		"<p>para</p>\n\n<div>\nx\n</div>\n\n<p>after</p>\n",
+
+		"para\n<!-- note -->\n\nafter\n",
+		"<p>para</p>\n\n<!-- note -->\n\n<p>after</p>\n",
+
+		"para\n* item\n",
+		"<p>para</p>\n\n<ul>\n<li>item</li>\n</ul>\n",
+
+		"para\n1. one\n",
+		"<p>para</p>\n\n<ol>\n<li>one</li>\n</ol>\n",
+
+		"para\n***\n",
+		"<p>para</p>\n\n<hr />\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_TABLES|EXTENSION_FENCED_CODE)
+	doTestsBlock(t, tests, EXTENSION_TABLES|EXTENSION_FENCED_CODE|EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK)
+
+	// the CommonMark rules keep these in the paragraph
+	tests = []string{
+		"para\n2. two\n",
+		"<p>para\n2. two</p>\n",
+
+		"para\n*  \nmore\n",
+		"<p>para\n*<br />\nmore</p>\n",
+
+		"para\n    code\n",
+		"<p>para\n    code</p>\n",
+
+		"para\n<span>x</span>\n",
+		"<p>para\n<span>x</span></p>\n",
+
+		"para\nA | B\n---|---\n1 | 2\n",
+		"<p>para\nA | B\n---|---\n1 | 2</p>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_TABLES)
+
+	// while legacy content relies on them ending it
+	tests = []string{
+		"para\n2. two\n",
+		"<p>para</p>\n\n<ol start=\"2\">\n<li>two</li>\n</ol>\n",
+
+		"para\n    code\n",
+		"<p>para</p>\n\n<pre><code>code\n</code></pre>\n",
+
+		"para\nA | B\n---|---\n1 | 2\n",
+		"<p>para</p>\n\n<table>\n<thead>\n<tr>\n<th>A</th>\n<th>B</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>1</td>\n<td>2</td>\n</tr>\n</tbody>\n</table>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_TABLES|EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK)
+}
@@ -0,0 +1,170 @@
+//
+// commonmark_test.go
+// Copyright (C) 2016 wanglong <wanglong@laoqinren.net>
+//
+// Distributed under terms of the MIT license.
+//
+
+package markdown
+
+import (
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testdata/spec-0.30.json is the spec.json of the CommonMark spec, version
+// 0.30, as the spec tools dump it, with every example under its number in
+// the spec.
+const commonMarkSpec = "testdata/spec-0.30.json"
+
+// the extensions that bring the parser closest to CommonMark
+const commonMarkExtensions = EXTENSION_FENCED_CODE |
+	EXTENSION_SPACE_HEADERS |
+	EXTENSION_BACKSLASH_LINE_BREAK
+
+// commonMarkFailures lists the examples the parser is known to get wrong.
+// An example that starts failing breaks the test; one that starts passing
+// is logged so that it can be taken off the list.
+var commonMarkFailures = map[int]bool{
+	// Tabs
+	1: true, 2: true, 3: true,
+	// Backslash escapes
+	12: true, 13: true, 20: true, 21: true, 24: true,
+	// Entity and numeric character references
+	26: true, 31: true, 32: true, 33: true, 34: true, 41: true,
+	// Thematic breaks
+	49: true,
+	// ATX headings
+	68: true, 70: true, 71: true, 73: true, 75: true, 76: true, 79: true,
+	// Setext headings
+	81: true, 82: true, 84: true, 86: true, 87: true, 90: true, 93: true, 95: true,
+	// Indented code blocks
+	112: true, 113: true,
+	// Fenced code blocks
+	121: true, 138: true,
+	// HTML blocks
+	148: true, 150: true, 151: true, 152: true, 153: true, 154: true, 155: true, 156: true, 157: true,
+	158: true, 161: true, 162: true, 163: true, 164: true, 165: true, 167: true, 168: true, 169: true,
+	170: true, 171: true, 172: true, 173: true, 174: true, 175: true, 176: true, 177: true, 178: true,
+	180: true, 181: true, 182: true, 183: true, 184: true, 186: true, 188: true, 191: true,
+	// Link reference definitions
+	194: true, 195: true, 196: true, 200: true, 201: true, 202: true, 204: true, 206: true, 208: true,
+	213: true, 218: true,
+	// Paragraphs
+	222: true, 223: true,
+	// Block quotes
+	238: true,
+	// List items
+	278: true, 280: true, 296: true, 297: true, 299: true, 300: true,
+	// Lists
+	301: true, 302: true, 307: true, 319: true,
+	// Code spans
+	330: true, 331: true, 332: true, 334: true, 335: true, 336: true, 337: true, 340: true, 341: true,
+	342: true, 346: true, 347: true, 349: true,
+	// Emphasis and strong emphasis
+	352: true, 353: true, 358: true, 359: true, 360: true, 361: true, 362: true, 367: true, 368: true,
+	371: true, 372: true, 373: true, 374: true, 375: true, 379: true, 384: true, 385: true, 386: true,
+	387: true, 388: true, 391: true, 392: true, 397: true, 398: true, 399: true, 400: true, 401: true,
+	405: true, 406: true, 407: true, 408: true, 409: true, 410: true, 411: true, 412: true, 413: true,
+	414: true, 415: true, 416: true, 417: true, 418: true, 424: true, 425: true, 426: true, 429: true,
+	430: true, 431: true, 442: true, 446: true, 454: true, 458: true, 463: true, 464: true, 465: true,
+	466: true, 467: true, 469: true, 472: true, 473: true, 474: true, 475: true, 476: true, 477: true,
+	478: true, 479: true, 480: true,
+	// Links
+	483: true, 484: true, 485: true, 486: true, 487: true, 488: true, 489: true, 490: true, 491: true,
+	492: true, 493: true, 498: true, 501: true, 502: true, 503: true, 504: true, 505: true, 506: true,
+	515: true, 517: true, 518: true, 519: true, 520: true, 523: true, 524: true, 525: true, 529: true,
+	531: true, 532: true, 533: true, 535: true, 536: true, 537: true, 539: true, 540: true, 543: true,
+	545: true, 549: true, 551: true, 563: true, 566: true, 567: true,
+	// Images
+	572: true, 573: true, 574: true, 575: true, 576: true, 584: true, 588: true,
+	// Autolinks
+	602: true,
+	// Raw HTML
+	618: true, 620: true, 621: true, 623: true, 625: true, 626: true, 627: true, 628: true, 629: true,
+	632: true,
+	// Hard line breaks
+	636: true, 637: true, 640: true, 641: true, 644: true, 646: true,
+	// Soft line breaks
+	649: true,
+}
+
+type commonMarkExample struct {
+	Markdown string `json:"markdown"`
+	Html     string `json:"html"`
+	Example  int    `json:"example"`
+	Section  string `json:"section"`
+}
+
+var (
+	betweenTags = regexp.MustCompile(`>\n+<`)
+	textRun     = regexp.MustCompile(`(^|>)([^<]+)`)
+)
+
+// normalizeHtml drops the line breaks between tags and writes the entities
+// of text one way, so that output differing only in layout compares equal
+func normalizeHtml(s string) string {
+	s = betweenTags.ReplaceAllString(strings.TrimSpace(s), "><")
+	return textRun.ReplaceAllStringFunc(s, func(run string) string {
+		prefix := ""
+		if strings.HasPrefix(run, ">") {
+			prefix, run = ">", run[1:]
+		}
+		return prefix + html.EscapeString(html.UnescapeString(run))
+	})
+}
+
+func TestCommonMark(t *testing.T) {
+	data, err := ioutil.ReadFile(commonMarkSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var examples []commonMarkExample
+	if err := json.Unmarshal(data, &examples); err != nil {
+		t.Fatal(err)
+	}
+
+	type tally struct{ passed, total int }
+	sections := map[string]*tally{}
+	passed := 0
+	for _, example := range examples {
+		renderer := HtmlRenderer(HTML_USE_XHTML, "", "")
+		output := MarkdownOptions([]byte(example.Markdown), renderer, Options{Extensions: commonMarkExtensions})
+		ok := normalizeHtml(string(output)) == normalizeHtml(example.Html)
+
+		count := sections[example.Section]
+		if count == nil {
+			count = &tally{}
+			sections[example.Section] = count
+		}
+		count.total++
+		if ok {
+			count.passed++
+			passed++
+		}
+
+		switch {
+		case ok && commonMarkFailures[example.Example]:
+			t.Logf("example %d (%s) is known to fail but passes", example.Example, example.Section)
+		case !ok && !commonMarkFailures[example.Example]:
+			t.Errorf("example %d (%s)\nInput   [%#v]\nExpected[%#v]\nActual  [%#v]",
+				example.Example, example.Section, example.Markdown, example.Html, string(output))
+		}
+	}
+
+	var names []string
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		count := sections[name]
+		t.Logf("%-40s %3d/%3d", name, count.passed, count.total)
+	}
+	t.Logf("%-40s %3d/%3d", "total", passed, len(examples))
+}
@@ -0,0 +1,236 @@
+//
+// fuzz_test.go
+// Copyright (C) 2016 wanglong <wanglong@laoqinren.net>
+//
+// Distributed under terms of the MIT license.
+//
+
+package markdown
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// the HTML flags the fuzz targets render with: raw HTML is left out, so
+// that the output has to be well-formed
+const fuzzHtmlFlags = HTML_USE_XHTML | HTML_SKIP_HTML | HTML_TOC |
+	HTML_FOOTNOTE_RETURN_LINKS | HTML_USE_SMARTYPANTS
+
+// addSeeds seeds f with an input for each kind of block and span, the
+// corner cases the block and inline tests cover, and the CommonMark examples
+func addSeeds(f *testing.F) {
+	for _, seed := range []string{
+		"# Header\n\nSome *emphasis*, **strong**, ***both*** and ~~struck~~.\n",
+		"#Header\n###### Six ####\n####### Seven\n#\n",
+		"Setext\n======\n\nSecond\n---\n",
+		"* * *\n\n-----\n\n_ _ _ x\n",
+		"> quote\n> * list\n>   1. nested\n\n    code\n",
+		"* loose\n\n* list\n  continued\n+ other\n1) x\n2. y\n",
+		"| a | b |\n|:--|--:|\n| 1 | 2 |\n|c\n",
+		"```go\ncode\n```\n\n~~~\nunclosed\n",
+		"Term\n: definition\n\nOther\n:   more\n\n    indented\n",
+		"[link](/url \"title\") ![image](/img 'x') <http://x.y> a@b.c www.x.y\n",
+		"[ref] [ref][] [text][ref]\n\n[ref]: /url (title)\n",
+		"text[^1] ^[inline]\n\n[^1]: note\n\n    more\n[^unclosed\n",
+		"% Title\n% Author\n\n<div>\nhtml\n</div>\n\n<!-- comment -->\n",
+		"# Header {#id}\n\n# <b>Markup</b> {#\"q\"}\n",
+		"line  \nbreak\\\nhere\r\n\ttab\n",
+		"`code` ``a ` b`` \\*escaped\\* &amp; &#35; &#x110000; &bogus\n",
+		"\"quotes\" 'single' -- --- ... (c) 1/2 3rd\n",
+		"***a*b**c* _a __b___ *a **b",
+		"[unclosed [nested](](x)\n<a href=\"x\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	data, err := ioutil.ReadFile(commonMarkSpec)
+	if err != nil {
+		f.Fatal(err)
+	}
+	var examples []commonMarkExample
+	if err := json.Unmarshal(data, &examples); err != nil {
+		f.Fatal(err)
+	}
+	for _, example := range examples {
+		f.Add([]byte(example.Markdown))
+	}
+}
+
+// voidElements are the elements the renderer writes without a closing tag
+var voidElements = map[string]bool{"br": true, "hr": true, "img": true, "input": true}
+
+// wellFormed checks that every tag of html is closed, in the order they
+// were opened, and that text has no stray angle brackets
+func wellFormed(html []byte) error {
+	var open []string
+	for i := 0; i < len(html); i++ {
+		switch html[i] {
+		case '>':
+			return fmt.Errorf("stray '>' at %d", i)
+		case '<':
+			end := bytes.IndexAny(html[i+1:], "<>")
+			if end < 0 || html[i+1+end] != '>' {
+				return fmt.Errorf("unterminated tag at %d", i)
+			}
+			tag := html[i+1 : i+1+end]
+			closing := len(tag) > 0 && tag[0] == '/'
+			if closing {
+				tag = tag[1:]
+			}
+			size := 0
+			for size < len(tag) && isalnum(tag[size]) {
+				size++
+			}
+			if size == 0 {
+				return fmt.Errorf("stray '<' at %d", i)
+			}
+			name := string(tag[:size])
+			switch {
+			case closing:
+				if len(open) == 0 || open[len(open)-1] != name {
+					return fmt.Errorf("unexpected </%s> at %d, open elements: %v", name, i, open)
+				}
+				open = open[:len(open)-1]
+			case !voidElements[name] && !bytes.HasSuffix(tag, []byte("/")):
+				open = append(open, name)
+			}
+			i += end + 1
+		}
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("unclosed elements: %v", open)
+	}
+	return nil
+}
+
+func TestWellFormed(t *testing.T) {
+	tests := map[string]bool{
+		"<p>a <em>b</em><br />\nc</p>\n":  true,
+		"<p><a href=\"x\">y</a> &lt;</p>": true,
+		"<p><em>a</p></em>":               false,
+		"<p>a":                            false,
+		"<p>a > b</p>":                    false,
+		"<p>a < b</p>":                    false,
+	}
+	for html, ok := range tests {
+		if err := wellFormed([]byte(html)); (err == nil) != ok {
+			t.Errorf("wellFormed(%q) = %v", html, err)
+		}
+	}
+}
+
+func FuzzMarkdown(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		for _, extensions := range fuzzExtensions {
+			renderer := HtmlRenderer(fuzzHtmlFlags, "", "")
+			output := MarkdownOptions(input, renderer, Options{Extensions: extensions})
+			if err := wellFormed(output); err != nil {
+				t.Errorf("extensions %#x: %v\n%s", extensions, err, output)
+			}
+		}
+	})
+}
+
+func FuzzInline(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		for _, extensions := range fuzzExtensions {
+			p := newParser(input, HtmlRenderer(fuzzHtmlFlags, "", ""), Options{Extensions: extensions})
+
+			// inline gets the text of a paragraph, with its newlines
+			// normalized and without the last one
+			data := bytes.TrimRight(firstRender(p, input), "\n")
+
+			var out bytes.Buffer
+			p.inline(&out, data)
+			if p.nesting != 0 {
+				t.Errorf("extensions %#x: nesting level %d after inline", extensions, p.nesting)
+			}
+			if err := wellFormed(out.Bytes()); err != nil {
+				t.Errorf("extensions %#x: %v\n%s", extensions, err, out.Bytes())
+			}
+		}
+	})
+}
+
+// blockRecognizers are the functions block uses to tell which block comes
+// next, each returning the size of the block or of its prefix. block only
+// hands them data that ends with a newline, but they must not read past
+// the end of any slice they get.
+var blockRecognizers = map[string]func(p *parser, data []byte) int{
+	"isPrefixHeader": func(p *parser, data []byte) int {
+		if p.isPrefixHeader(data) {
+			return 1
+		}
+		return 0
+	},
+	"isUnderlineHeader": func(p *parser, data []byte) int { return p.isUnderlineHeader(data) },
+	"isHRule": func(p *parser, data []byte) int {
+		if p.isHRule(data) {
+			return 1
+		}
+		return 0
+	},
+	"isEmpty":     func(p *parser, data []byte) int { return p.isEmpty(data) },
+	"html":        func(p *parser, data []byte) int { return p.html(nil, data, false) },
+	"codePrefix":  func(p *parser, data []byte) int { return p.codePrefix(data) },
+	"fencedCode":  func(p *parser, data []byte) int { return p.fencedCode(nil, data, false) },
+	"quotePrefix": func(p *parser, data []byte) int { return p.quotePrefix(data) },
+	"uliPrefix":   func(p *parser, data []byte) int { return p.uliPrefix(data) },
+	"oliPrefix":   func(p *parser, data []byte) int { return p.oliPrefix(data) },
+	"dliPrefix":   func(p *parser, data []byte) int { return p.dliPrefix(data) },
+	"dlTermEnd":   func(p *parser, data []byte) int { return p.dlTermEnd(data) },
+	"tableHeader": func(p *parser, data []byte) int {
+		size, _ := p.tableHeader(nil, data, false)
+		return size
+	},
+	"interruptsParagraph": func(p *parser, data []byte) int {
+		if p.interruptsParagraph(data) {
+			return 1
+		}
+		return 0
+	},
+	"isReference": func(p *parser, data []byte) int { return isReference(p, data, p.tabSize()) },
+}
+
+func FuzzBlock(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		for _, extensions := range fuzzExtensions {
+			p := newParser(input, HtmlRenderer(fuzzHtmlFlags, "", ""), Options{Extensions: extensions})
+
+			// block gets the input as firstRender leaves it, and tries
+			// each recognizer at the start of every line; the
+			// recognizers also get the raw input and each line without
+			// its newline
+			data := firstRender(p, input)
+			slices := [][]byte{input}
+			for start := 0; start < len(data); {
+				end := skipUntilChar(data, start, '\n')
+				slices = append(slices, data[start:], data[start:end])
+				start = end + 1
+			}
+			for _, slice := range slices {
+				for name, recognize := range blockRecognizers {
+					if size := recognize(p, slice); size < 0 || size > len(slice) {
+						t.Errorf("extensions %#x: %s returned %d for %q", extensions, name, size, slice)
+					}
+				}
+			}
+
+			var out bytes.Buffer
+			p.block(&out, data)
+			if p.nesting != 0 {
+				t.Errorf("extensions %#x: nesting level %d after block", extensions, p.nesting)
+			}
+			if err := wellFormed(out.Bytes()); err != nil {
+				t.Errorf("extensions %#x: %v\n%s", extensions, err, out.Bytes())
+			}
+		}
+	})
+}
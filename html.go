@@ -16,6 +16,7 @@ package markdown
 import (
 	"bytes"
 	"fmt"
+	"strings"
 )
 
 // Html renderer configuration options.
@@ -31,12 +32,12 @@ const (
 	HTML_TOC
 	HTML_OMIT_CONTENTS
 	HTML_COMPLETE_PAGE
-	HTML_USE_XHTML // generate XHTML output instead of HTML
-	HTML_USE_SMARTYPANTS
-	HTML_SMARTYPANTS_FRACTIONS
-	HTML_SMARTYPANTS_DASHES
-	HTML_SMARTYPANTS_LATEX_DASHES
-	HTML_SMARTYPANTS_ANGLED_QUOTES
+	HTML_USE_XHTML                 // generate XHTML output instead of HTML
+	HTML_USE_SMARTYPANTS           // enable smart punctuation substitutions
+	HTML_SMARTYPANTS_FRACTIONS     // enable smart fractions (with HTML_USE_SMARTYPANTS)
+	HTML_SMARTYPANTS_DASHES        // enable smart dashes (with HTML_USE_SMARTYPANTS)
+	HTML_SMARTYPANTS_LATEX_DASHES  // enable LaTeX-style dashes (with HTML_SMARTYPANTS_DASHES)
+	HTML_SMARTYPANTS_ANGLED_QUOTES // enable angled double quotes (with HTML_USE_SMARTYPANTS)
 	HTML_FOOTNOTE_RETURN_LINKS
 )
 
@@ -63,6 +64,7 @@ type Html struct {
 	flags    int    // HTML_* options
 	closeTag string // The close tag: either " />" or ">"
 	title    string // The document title
+	docTitle string // The title of the title block of the document, if any
 	css      string // Optional css file url
 
 	parameters HtmlRendererParameters
@@ -75,6 +77,17 @@ type Html struct {
 
 	// Track header Ids to prevent ID collision in a single generation
 	headerIDs map[string]int
+
+	// the anchors of the footnotes, by name, the anchors taken, and how
+	// many times each footnote has been referenced
+	footnoteAnchors map[string]string
+	footnoteTaken   map[string]bool
+	footnoteRefs    map[string]int
+
+	// SmartyPants callbacks, and the quote state carried from one piece
+	// of normal text to the next within a block
+	smartypants *smartypantsRenderer
+	smrt        smartypantsData
 }
 
 const (
@@ -101,7 +114,7 @@ func HtmlRendererWithParameters(flags int, title, css string, renderParameters H
 	}
 
 	if renderParameters.FootnoteReturnLinkContents == "" {
-		renderParameters.FootnoteReturnLinkContents = `<sup>[return</sup>]`
+		renderParameters.FootnoteReturnLinkContents = `<sup>[return]</sup>`
 	}
 
 	return &Html{
@@ -114,6 +127,11 @@ func HtmlRendererWithParameters(flags int, title, css string, renderParameters H
 		currentLevel: 0,
 		toc:          new(bytes.Buffer),
 		headerIDs:    make(map[string]int),
+		smartypants:  smartypants(flags),
+
+		footnoteAnchors: make(map[string]string),
+		footnoteTaken:   make(map[string]bool),
+		footnoteRefs:    make(map[string]int),
 	}
 }
 
@@ -121,7 +139,20 @@ func (html *Html) GetFlags() int {
 	return html.flags
 }
 
+// NeedsWholeDocument tells Render to hold back the output for the table of
+// contents, which goes ahead of the blocks it lists
+func (html *Html) NeedsWholeDocument() bool {
+	return html.flags&HTML_TOC != 0
+}
+
 func (html *Html) DocumentHeader(out *bytes.Buffer) {
+	// the title block of this document is not the one of the next
+	title := html.title
+	if title == "" {
+		title = html.docTitle
+	}
+	html.docTitle = ""
+
 	if html.flags&HTML_COMPLETE_PAGE == 0 {
 		return
 	}
@@ -140,7 +171,7 @@ func (html *Html) DocumentHeader(out *bytes.Buffer) {
 
 	out.WriteString("<head>\n")
 	out.WriteString("  <title>")
-	html.NormalText(out, []byte(html.title))
+	html.NormalText(out, []byte(title))
 	out.WriteString("</title>\n")
 	out.WriteString("  <meta name=\"GENERATOR\" content=\"Markdown Processor v")
 	out.WriteString(VERSION)
@@ -163,8 +194,44 @@ func (html *Html) DocumentHeader(out *bytes.Buffer) {
 }
 
 func (html *Html) DocumentFooter(out *bytes.Buffer) {
-	// finalize an d insert the table of contents
+	// finalize and insert the table of contents
 	if html.flags&HTML_TOC != 0 {
+		html.tocFinalize()
+	}
+
+	// without headers there is no table of contents to insert
+	if html.flags&HTML_TOC != 0 && html.toc.Len() == 0 && html.flags&HTML_OMIT_CONTENTS != 0 {
+		out.Truncate(html.tocMarker)
+	}
+
+	if html.flags&HTML_TOC != 0 && html.toc.Len() > 0 {
+		// now we have to insert the table of contents into the document
+		var temp bytes.Buffer
+
+		// start by making a copy of everything after the document header
+		temp.Write(out.Bytes()[html.tocMarker:])
+
+		// now clear the copied material from the main output buffer
+		out.Truncate(html.tocMarker)
+
+		// corner case spacing issue
+		if html.flags&HTML_COMPLETE_PAGE != 0 {
+			out.WriteByte('\n')
+		}
+
+		// insert the table of contents
+		out.WriteString("<nav>\n")
+		out.Write(html.toc.Bytes())
+		out.WriteString("</nav>\n")
+
+		// write out everything that came after it
+		if html.flags&HTML_OMIT_CONTENTS == 0 {
+			// corner case spacing issue
+			if html.flags&HTML_COMPLETE_PAGE == 0 && temp.Len() > 0 {
+				out.WriteByte('\n')
+			}
+			out.Write(temp.Bytes())
+		}
 	}
 
 	if html.flags&HTML_COMPLETE_PAGE != 0 {
@@ -196,6 +263,7 @@ func (html *Html) ensureUniqueHeaderID(id string) string {
 func (html *Html) Header(out *bytes.Buffer, header func() bool, level int, id string) {
 	marker := out.Len()
 	doubleSpace(out)
+	html.smrt = smartypantsData{}
 
 	if id == "" && html.flags&HTML_TOC != 0 {
 		id = fmt.Sprintf("toc_%d", html.headerCount)
@@ -211,20 +279,156 @@ func (html *Html) Header(out *bytes.Buffer, header func() bool, level int, id st
 		if html.parameters.HeaderIDSuffix != "" {
 			id = id + html.parameters.HeaderIDSuffix
 		}
-		out.WriteString(fmt.Sprintf("<h%d id=\"%s\">", level, id))
+		out.WriteString(fmt.Sprintf("<h%d id=\"", level))
+		attrEscape(out, []byte(id))
+		out.WriteString("\">")
 	} else {
 		out.WriteString(fmt.Sprintf("<h%d>", level))
 	}
 
-	//tocMarker := out.Len()
+	tocMarker := out.Len()
 	if !header() {
 		out.Truncate(marker)
 		return
 	}
 
+	// are we building a table of contents?
+	if html.flags&HTML_TOC != 0 {
+		html.tocHeader(out.Bytes()[tocMarker:], level, id)
+	}
+
 	out.WriteString(fmt.Sprintf("</h%d>\n", level))
 }
 
+// tocHeader adds a header to the table of contents, opening and closing
+// nested lists to reach its level
+func (html *Html) tocHeader(text []byte, level int, id string) {
+	for level > html.currentLevel {
+		switch {
+		case bytes.HasSuffix(html.toc.Bytes(), []byte("</li>\n")):
+			// this sublist can nest underneath a header
+			html.toc.Truncate(html.toc.Len() - len("</li>\n"))
+		case html.currentLevel > 0:
+			html.toc.WriteString("<li>")
+		}
+		if html.toc.Len() > 0 {
+			html.toc.WriteByte('\n')
+		}
+		html.toc.WriteString("<ul>\n")
+		html.currentLevel++
+	}
+
+	for level < html.currentLevel {
+		html.toc.WriteString("</ul>")
+		if html.currentLevel > 1 {
+			html.toc.WriteString("</li>\n")
+		}
+		html.currentLevel--
+	}
+
+	html.toc.WriteString("<li><a href=\"#")
+	attrEscape(html.toc, []byte(id))
+	html.toc.WriteString("\">")
+	html.headerCount++
+
+	// links in the header text would nest inside the entry's own link
+	org := 0
+	for i := 0; i < len(text); i++ {
+		if text[i] != '<' {
+			continue
+		}
+		kind := LINK_TYPE_NOT_AUTOLINK
+		if end := tagLength(text[i:], &kind); end > 0 && isHtmlTag(text[i:i+end], "a") {
+			html.toc.Write(text[org:i])
+			i += end - 1
+			org = i + 1
+		}
+	}
+	html.toc.Write(text[org:])
+
+	html.toc.WriteString("</a></li>\n")
+}
+
+// tocFinalize closes the lists still open in the table of contents
+func (html *Html) tocFinalize() {
+	for html.currentLevel > 1 {
+		html.toc.WriteString("</ul></li>\n")
+		html.currentLevel--
+	}
+
+	if html.currentLevel > 0 {
+		html.toc.WriteString("</ul>\n")
+	}
+}
+
+func (html *Html) TitleBlock(out *bytes.Buffer, text []byte) {
+	fields := bytes.Split(text, []byte("\n"))
+
+	// the title of a complete page defaults to the one of the document
+	html.docTitle = string(fields[0])
+
+	if len(fields[0]) > 0 {
+		doubleSpace(out)
+		out.WriteString("<h1 class=\"title\">")
+		html.NormalText(out, fields[0])
+		out.WriteString("</h1>\n")
+	}
+	for i, class := range []string{"author", "date"} {
+		if i+1 < len(fields) && len(fields[i+1]) > 0 {
+			doubleSpace(out)
+			out.WriteString("<p class=\"" + class + "\">")
+			html.NormalText(out, fields[i+1])
+			out.WriteString("</p>\n")
+		}
+	}
+}
+
+func (html *Html) Footnotes(out *bytes.Buffer, text func() bool) {
+	doubleSpace(out)
+	out.WriteString("<div class=\"footnotes\">\n")
+	html.HRule(out)
+	html.List(out, text, LIST_TYPE_ORDERED, 1)
+	out.WriteString("</div>\n")
+}
+
+func (html *Html) FootnoteItem(out *bytes.Buffer, name, text []byte, flags int) {
+	html.smrt = smartypantsData{}
+	if flags&LIST_ITEM_CONTAINS_BLOCK != 0 || flags&LIST_ITEM_BEGINNING_OF_LIST != 0 {
+		doubleSpace(out)
+	}
+	slug := html.footnoteAnchor(name)
+	out.WriteString(`<li id="fn:`)
+	out.WriteString(html.parameters.FootnoteAnchorPrefix)
+	out.WriteString(slug)
+	out.WriteString(`">`)
+	out.Write(text)
+	if html.flags&HTML_FOOTNOTE_RETURN_LINKS != 0 {
+		out.WriteString(` <a class="footnote-return" href="#fnref:`)
+		out.WriteString(html.parameters.FootnoteAnchorPrefix)
+		out.WriteString(slug)
+		out.WriteString(`">`)
+		out.WriteString(html.parameters.FootnoteReturnLinkContents)
+		out.WriteString(`</a>`)
+	}
+	out.WriteString("</li>\n")
+}
+
+func (html *Html) HRule(out *bytes.Buffer) {
+	doubleSpace(out)
+	out.WriteString("<hr")
+	out.WriteString(html.closeTag)
+	out.WriteByte('\n')
+}
+
+func (html *Html) Entity(out *bytes.Buffer, entity []byte) {
+	// the parser only passes on numeric references to valid code points
+	if entity[1] != '#' && !isNamedEntity(entity) {
+		attrEscape(out, entity)
+		return
+	}
+	out.Write(entity)
+}
+
 func (html *Html) NormalText(out *bytes.Buffer, text []byte) {
 	if html.flags&HTML_USE_SMARTYPANTS != 0 {
 		html.Smartypants(out, text)
@@ -234,7 +438,30 @@ func (html *Html) NormalText(out *bytes.Buffer, text []byte) {
 }
 
 func (html *Html) Smartypants(out *bytes.Buffer, text []byte) {
+	// first do normal entity escaping
+	var escaped bytes.Buffer
+	attrEscape(&escaped, text)
+	text = escaped.Bytes()
+
+	mark := 0
+	for i := 0; i < len(text); i++ {
+		if action := html.smartypants[text[i]]; action != nil {
+			if i > mark {
+				out.Write(text[mark:i])
+			}
+
+			previousChar := byte(0)
+			if i > 0 {
+				previousChar = text[i-1]
+			}
+			i += action(out, &html.smrt, previousChar, text[i:])
+			mark = i + 1
+		}
+	}
 
+	if mark < len(text) {
+		out.Write(text[mark:])
+	}
 }
 
 func (html *Html) Emphasis(out *bytes.Buffer, text []byte) {
@@ -280,12 +507,13 @@ func (html *Html) CodeSpan(out *bytes.Buffer, text []byte) {
 		return
 	}
 	out.WriteString("<code>")
-	out.Write(text)
+	attrEscape(out, text)
 	out.WriteString("</code>")
 }
 func (html *Html) Paragraph(out *bytes.Buffer, text func() bool) {
 	marker := out.Len()
 	doubleSpace(out)
+	html.smrt = smartypantsData{}
 	out.WriteString("<p>")
 	if !text() {
 		out.Truncate(marker)
@@ -294,6 +522,356 @@ func (html *Html) Paragraph(out *bytes.Buffer, text func() bool) {
 	out.WriteString("</p>\n")
 }
 
+func (html *Html) BlockCode(out *bytes.Buffer, text []byte, lang string) {
+	doubleSpace(out)
+
+	// only the first word of the info string names the language
+	if end := strings.IndexAny(lang, "\t "); end >= 0 {
+		lang = lang[:end]
+	}
+
+	if lang == "" {
+		out.WriteString("<pre><code>")
+	} else {
+		out.WriteString("<pre><code class=\"language-")
+		attrEscape(out, []byte(lang))
+		out.WriteString("\">")
+	}
+	attrEscape(out, text)
+	out.WriteString("</code></pre>\n")
+}
+
+func (html *Html) BlockQuote(out *bytes.Buffer, text []byte) {
+	doubleSpace(out)
+	out.WriteString("<blockquote>\n")
+	out.Write(text)
+	out.WriteString("</blockquote>\n")
+}
+
+func (html *Html) BlockHtml(out *bytes.Buffer, text []byte) {
+	if html.flags&HTML_SKIP_HTML != 0 {
+		return
+	}
+
+	var block bytes.Buffer
+	html.writeHtml(&block, text)
+	if len(bytes.TrimSpace(block.Bytes())) == 0 {
+		return
+	}
+
+	doubleSpace(out)
+	out.Write(block.Bytes())
+	out.WriteByte('\n')
+}
+
+func (html *Html) List(out *bytes.Buffer, text func() bool, flags, start int) {
+	marker := out.Len()
+	doubleSpace(out)
+	html.smrt = smartypantsData{}
+
+	if flags&LIST_TYPE_DEFINITION != 0 {
+		out.WriteString("<dl>")
+	} else if flags&LIST_TYPE_ORDERED == 0 {
+		out.WriteString("<ul>")
+	} else if start != 1 {
+		out.WriteString(fmt.Sprintf("<ol start=\"%d\">", start))
+	} else {
+		out.WriteString("<ol>")
+	}
+	if !text() {
+		out.Truncate(marker)
+		return
+	}
+	if flags&LIST_TYPE_DEFINITION != 0 {
+		out.WriteString("</dl>\n")
+	} else if flags&LIST_TYPE_ORDERED != 0 {
+		out.WriteString("</ol>\n")
+	} else {
+		out.WriteString("</ul>\n")
+	}
+}
+
+func (html *Html) ListItem(out *bytes.Buffer, text []byte, flags int) {
+	// text is rendered already, so this is for the item after it
+	html.smrt = smartypantsData{}
+	if (flags&LIST_ITEM_CONTAINS_BLOCK != 0 && flags&LIST_TYPE_DEFINITION == 0) ||
+		flags&LIST_ITEM_BEGINNING_OF_LIST != 0 {
+		doubleSpace(out)
+	}
+	switch {
+	case flags&LIST_TYPE_TERM != 0:
+		out.WriteString("<dt>")
+		out.Write(text)
+		out.WriteString("</dt>\n")
+	case flags&LIST_TYPE_DEFINITION != 0:
+		out.WriteString("<dd>")
+		out.Write(text)
+		out.WriteString("</dd>\n")
+	default:
+		out.WriteString("<li>")
+		out.Write(text)
+		out.WriteString("</li>\n")
+	}
+}
+
+func (html *Html) Table(out *bytes.Buffer, header []byte, body []byte, columnData []int) {
+	doubleSpace(out)
+	out.WriteString("<table>\n<thead>\n")
+	out.Write(header)
+	out.WriteString("</thead>\n\n<tbody>\n")
+	out.Write(body)
+	out.WriteString("</tbody>\n</table>\n")
+}
+
+func (html *Html) TableRow(out *bytes.Buffer, text []byte) {
+	doubleSpace(out)
+	out.WriteString("<tr>\n")
+	out.Write(text)
+	out.WriteString("\n</tr>\n")
+}
+
+func (html *Html) TableHeaderCell(out *bytes.Buffer, text []byte, align int) {
+	doubleSpace(out)
+	html.smrt = smartypantsData{}
+	out.WriteString("<th")
+	html.tableCellAlign(out, align)
+	out.WriteString(">")
+	out.Write(text)
+	out.WriteString("</th>")
+}
+
+func (html *Html) TableCell(out *bytes.Buffer, text []byte, align int) {
+	doubleSpace(out)
+	html.smrt = smartypantsData{}
+	out.WriteString("<td")
+	html.tableCellAlign(out, align)
+	out.WriteString(">")
+	out.Write(text)
+	out.WriteString("</td>")
+}
+
+// tableCellAlign writes the align attribute for a table cell, if any
+func (html *Html) tableCellAlign(out *bytes.Buffer, align int) {
+	switch align {
+	case TABLE_ALIGNMENT_LEFT:
+		out.WriteString(" align=\"left\"")
+	case TABLE_ALIGNMENT_RIGHT:
+		out.WriteString(" align=\"right\"")
+	case TABLE_ALIGNMENT_CENTER:
+		out.WriteString(" align=\"center\"")
+	}
+}
+
+func (html *Html) AutoLink(out *bytes.Buffer, link []byte, kind int) {
+	// write the link text out but don't link it
+	if html.flags&HTML_SKIP_LINKS != 0 {
+		attrEscape(out, link)
+		return
+	}
+	if html.flags&HTML_SAFELINK != 0 && kind != LINK_TYPE_EMAIL && !isSafeLink(link) {
+		attrEscape(out, link)
+		return
+	}
+
+	out.WriteString("<a href=\"")
+	if kind == LINK_TYPE_EMAIL {
+		out.WriteString("mailto:")
+	} else {
+		html.maybeWriteAbsolutePrefix(out, link)
+	}
+	attrEscape(out, link)
+
+	if kind != LINK_TYPE_EMAIL {
+		var relAttrs []string
+		if html.flags&HTML_NOFOLLOW_LINKS != 0 && !isRelativeLink(link) {
+			relAttrs = append(relAttrs, "nofollow")
+		}
+		if html.flags&HTML_NOREFERRER_LINKS != 0 && !isRelativeLink(link) {
+			relAttrs = append(relAttrs, "noreferrer")
+		}
+		if len(relAttrs) > 0 {
+			out.WriteString(fmt.Sprintf("\" rel=\"%s", strings.Join(relAttrs, " ")))
+		}
+
+		// blank target only add to external link
+		if html.flags&HTML_HREF_TARGET_BLANK != 0 && !isRelativeLink(link) {
+			out.WriteString("\" target=\"_blank")
+		}
+	}
+
+	out.WriteString("\">")
+	attrEscape(out, link)
+	out.WriteString("</a>")
+}
+
+func (html *Html) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
+	// write the link text out but don't link it
+	if html.flags&HTML_SKIP_LINKS != 0 {
+		out.Write(content)
+		return
+	}
+	if html.flags&HTML_SAFELINK != 0 && !isSafeLink(link) {
+		out.Write(content)
+		return
+	}
+
+	out.WriteString("<a href=\"")
+	html.maybeWriteAbsolutePrefix(out, link)
+	attrEscape(out, link)
+	if len(title) > 0 {
+		out.WriteString("\" title=\"")
+		attrEscape(out, title)
+	}
+
+	var relAttrs []string
+	if html.flags&HTML_NOFOLLOW_LINKS != 0 && !isRelativeLink(link) {
+		relAttrs = append(relAttrs, "nofollow")
+	}
+	if html.flags&HTML_NOREFERRER_LINKS != 0 && !isRelativeLink(link) {
+		relAttrs = append(relAttrs, "noreferrer")
+	}
+	if len(relAttrs) > 0 {
+		out.WriteString(fmt.Sprintf("\" rel=\"%s", strings.Join(relAttrs, " ")))
+	}
+
+	// blank target only add to external link
+	if html.flags&HTML_HREF_TARGET_BLANK != 0 && !isRelativeLink(link) {
+		out.WriteString("\" target=\"_blank")
+	}
+
+	out.WriteString("\">")
+	out.Write(content)
+	out.WriteString("</a>")
+}
+
+func (html *Html) Image(out *bytes.Buffer, link []byte, title []byte, alt []byte) {
+	if html.flags&HTML_SKIP_IMAGES != 0 {
+		return
+	}
+	if html.flags&HTML_SAFELINK != 0 && !isSafeLink(link) {
+		attrEscape(out, alt)
+		return
+	}
+
+	out.WriteString("<img src=\"")
+	html.maybeWriteAbsolutePrefix(out, link)
+	attrEscape(out, link)
+	out.WriteString("\" alt=\"")
+	attrEscape(out, alt)
+	if len(title) > 0 {
+		out.WriteString("\" title=\"")
+		attrEscape(out, title)
+	}
+
+	out.WriteByte('"')
+	out.WriteString(html.closeTag)
+}
+
+func (html *Html) RawHtmlTag(out *bytes.Buffer, text []byte) {
+	if html.flags&HTML_SKIP_HTML != 0 || html.skipTag(text) {
+		return
+	}
+	out.Write(text)
+}
+
+// skipTag tells whether tag is one the HTML_SKIP_* flags leave out
+func (html *Html) skipTag(tag []byte) bool {
+	switch {
+	case html.flags&HTML_SKIP_STYLE != 0 && isHtmlTag(tag, "style"):
+		return true
+	case html.flags&HTML_SKIP_LINKS != 0 && isHtmlTag(tag, "a"):
+		return true
+	case html.flags&HTML_SKIP_IMAGES != 0 && isHtmlTag(tag, "img"):
+		return true
+	}
+	return false
+}
+
+// writeHtml copies raw html out without the tags skipped by the flags; a
+// skipped style element goes along with its contents
+func (html *Html) writeHtml(out *bytes.Buffer, text []byte) {
+	org, i := 0, 0
+	for i < len(text) {
+		if text[i] != '<' {
+			i++
+			continue
+		}
+
+		kind := LINK_TYPE_NOT_AUTOLINK
+		end := tagLength(text[i:], &kind)
+		if end == 0 {
+			i++
+			continue
+		}
+		tag := text[i : i+end]
+		if !html.skipTag(tag) {
+			i += end
+			continue
+		}
+
+		out.Write(text[org:i])
+		i += end
+		if isHtmlTag(tag, "style") && tag[1] != '/' {
+			if close := styleEnd(text[i:]); close > 0 {
+				i += close
+			} else {
+				i = len(text)
+			}
+		}
+		org = i
+	}
+	out.Write(text[org:])
+}
+
+// maybeWriteAbsolutePrefix prepends AbsolutePrefix to links relative to the
+// site; links to an anchor or relative to the current page are left alone
+func (html *Html) maybeWriteAbsolutePrefix(out *bytes.Buffer, link []byte) {
+	if html.parameters.AbsolutePrefix == "" || !isRelativeLink(link) {
+		return
+	}
+	if link[0] == '#' || link[0] == '.' {
+		return
+	}
+	out.WriteString(html.parameters.AbsolutePrefix)
+	if link[0] != '/' {
+		out.WriteByte('/')
+	}
+}
+
+// footnoteAnchor returns the anchor of the footnote called name: its
+// sanitized name, numbered when that of another footnote sanitizes the same
+func (html *Html) footnoteAnchor(name []byte) string {
+	if slug, found := html.footnoteAnchors[string(name)]; found {
+		return slug
+	}
+	base := SanitizedString(string(name))
+	slug := base
+	for count := 1; html.footnoteTaken[slug]; count++ {
+		slug = fmt.Sprintf("%s-%d", base, count)
+	}
+	html.footnoteAnchors[string(name)] = slug
+	html.footnoteTaken[slug] = true
+	return slug
+}
+
+func (html *Html) FootnoteRef(out *bytes.Buffer, ref []byte, id int) {
+	slug := html.footnoteAnchor(ref)
+
+	// the footnote links back to its first reference; the others get ids
+	// of their own
+	html.footnoteRefs[slug]++
+	out.WriteString(`<sup class="footnote-ref" id="fnref:`)
+	out.WriteString(html.parameters.FootnoteAnchorPrefix)
+	out.WriteString(slug)
+	if count := html.footnoteRefs[slug]; count > 1 {
+		out.WriteString(fmt.Sprintf(":%d", count))
+	}
+	out.WriteString(`"><a rel="footnote" href="#fn:`)
+	out.WriteString(html.parameters.FootnoteAnchorPrefix)
+	out.WriteString(slug)
+	out.WriteString(fmt.Sprintf(`">%d</a></sup>`, id))
+}
+
 func (html *Html) LineBreak(out *bytes.Buffer) {
 	out.WriteString("<br")
 	out.WriteString(html.closeTag)
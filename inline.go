@@ -12,6 +12,8 @@ package markdown
 
 import (
 	"bytes"
+	"strconv"
+	"unicode/utf8"
 )
 
 // Functons to parse text with a block
@@ -22,19 +24,27 @@ import (
 func (p *parser) inline(out *bytes.Buffer, input []byte) {
 	// this is called recurively: enforce a maximum depth
 	if p.nesting >= p.maxNesting {
+		p.truncate(out, ErrTooDeep, input)
 		return
 	}
 
 	p.nesting++
 
+	// an <a> tag passed through as raw html only lasts for this span
+	insideLink := p.insideLink
+
 	i, end := 0, 0
 
-	for i < len(input) {
+	// plain text takes no steps, so look at the output ahead of it too
+	p.checkOutput(out)
+
+	for i < len(input) && !p.stopped {
 		// copy inactive chars into output
 		for end < len(input) && p.inlineCallback[input[end]] == nil {
 			end++
 		}
 
+		p.span(input[i:end])
 		p.r.NormalText(out, input[i:end])
 
 		if end >= len(input) {
@@ -43,7 +53,19 @@ func (p *parser) inline(out *bytes.Buffer, input []byte) {
 
 		i = end
 
-		// call the grigger
+		// call the grigger, within the budget
+		p.move(input[i:])
+		p.checkContext()
+		if p.checkOutput(out); p.stopped {
+			break
+		}
+		if p.maxInlineCalls > 0 {
+			if p.inlineCalls >= p.maxInlineCalls {
+				p.stop(out, ErrTooManyInlineCalls, input[i:])
+				break
+			}
+			p.inlineCalls++
+		}
 		handler := p.inlineCallback[input[end]]
 		if consumed := handler(p, out, input, i); consumed == 0 {
 			// no action from the callback; buffer the byte for later
@@ -54,6 +76,7 @@ func (p *parser) inline(out *bytes.Buffer, input []byte) {
 			end = i
 		}
 	}
+	p.insideLink = insideLink
 	p.nesting--
 }
 
@@ -67,6 +90,7 @@ func escape(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 		if bytes.IndexByte(escapeChars, data[1]) < 0 {
 			return 0
 		}
+		p.span(data[:2])
 		p.r.NormalText(out, data[1:2])
 	}
 	return 2
@@ -166,6 +190,7 @@ func helperEmphasis(p *parser, out *bytes.Buffer, data []byte, c byte) int {
 			}
 			var work bytes.Buffer
 			p.inline(&work, data[:i])
+			p.spanAround(data[:i+1], 1)
 			p.r.Emphasis(out, work.Bytes())
 			return i + 1
 		}
@@ -188,6 +213,7 @@ func helperDoubleEmphasis(p *parser, out *bytes.Buffer, data []byte, c byte) int
 			p.inline(&work, data[:i])
 
 			if work.Len() > 0 {
+				p.spanAround(data[:i+2], 2)
 				// pick up the right renderer
 				if c == '~' {
 					p.r.StrikeThrough(out, work.Bytes())
@@ -214,9 +240,12 @@ func helperTripleEmphasis(p *parser, out *bytes.Buffer, data []byte, offset int,
 			return 0
 		}
 		i += length
+		if i >= len(data) {
+			return 0
+		}
 
 		// skip whitespace  proceded symbols
-		if data[i] != c || isspace(data[i-1]) {
+		if data[i] != c || (i > 0 && isspace(data[i-1])) {
 			continue
 		}
 
@@ -227,6 +256,7 @@ func helperTripleEmphasis(p *parser, out *bytes.Buffer, data []byte, offset int,
 
 			p.inline(&work, data[:i])
 			if work.Len() > 0 {
+				p.span(origData[:offset+i+3])
 				p.r.TripleEmphasis(out, work.Bytes())
 			}
 			return i + 3
@@ -289,6 +319,7 @@ func codeSpan(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 
 	// render the code span
 	if first != last {
+		p.span(data[:end])
 		p.r.CodeSpan(out, data[first:last])
 	}
 
@@ -314,9 +345,627 @@ func lineBreak(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 		return 0
 	}
 
-	if precededByBackslash && eol > 0 {
-		out.Truncate(eol - 1)
+	start := offset
+	if precededByBackslash {
+		start--
+		if eol > 0 {
+			out.Truncate(eol - 1)
+		}
+	} else {
+		for start > 0 && data[start-1] == ' ' {
+			start--
+		}
 	}
+	p.span(data[start : offset+1])
 	p.r.LineBreak(out)
 	return 1
 }
+
+type linkType int
+
+const (
+	linkNormal linkType = iota
+	linkImg
+	linkDeferredFootnote
+)
+
+// '[': parse a link or an image or a footnote
+func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+	t := linkNormal
+
+	switch {
+	// [^refId] == deferred footnote
+	case p.flags&EXTENSION_FOOTNOTES != 0 && len(data)-1 > offset && data[offset+1] == '^':
+		t = linkDeferredFootnote
+
+	// ![alt] == image
+	case offset > 0 && data[offset-1] == '!' && !isBackslashEscaped(data, offset-1):
+		t = linkImg
+	}
+
+	// no links or footnotes allowed inside other links
+	if p.insideLink && t != linkImg {
+		return 0
+	}
+
+	data = data[offset:]
+
+	if t == linkDeferredFootnote {
+		return footnoteRef(p, out, data)
+	}
+
+	var (
+		i                       = 1
+		title, link, altContent []byte
+	)
+
+	// look for the matching closing bracket, giving up past the nesting
+	// limit so that the scan from each '[' stays short
+	for level := 1; level > 0 && i < len(data); i++ {
+		switch {
+		case data[i-1] == '\\':
+			continue
+
+		case data[i] == '[':
+			if level++; level > p.maxNesting {
+				return 0
+			}
+
+		case data[i] == ']':
+			level--
+			if level <= 0 {
+				i-- // compensate for extra i++ in for loop
+			}
+		}
+	}
+
+	if i >= len(data) {
+		return 0
+	}
+
+	txtE := i
+	i++
+
+	switch {
+	// inline style link
+	case i < len(data) && data[i] == '(':
+		// skip initial whitespace
+		i++
+		for i < len(data) && isspace(data[i]) {
+			i++
+		}
+
+		linkB := i
+
+		// look for link end: ' " ), taking nested parentheses into account
+		// up to the nesting limit
+		brace := 0
+	findlinkend:
+		for i < len(data) {
+			switch {
+			case data[i] == '\\':
+				i += 2
+
+			case data[i] == '(':
+				if brace++; brace > p.maxNesting {
+					return 0
+				}
+				i++
+
+			case data[i] == ')':
+				if brace <= 0 {
+					break findlinkend
+				}
+				brace--
+				i++
+
+			case data[i] == '\'' || data[i] == '"':
+				break findlinkend
+
+			default:
+				i++
+			}
+		}
+
+		if i >= len(data) {
+			return 0
+		}
+		linkE := i
+
+		// look for title end if present: the matching quote, followed by
+		// nothing but whitespace up to the ')'
+		titleB, titleE := 0, 0
+		if data[i] == '\'' || data[i] == '"' {
+			quote := data[i]
+			i++
+			titleB = i
+
+		findtitleend:
+			for i < len(data) {
+				switch {
+				case data[i] == '\\':
+					i += 2
+
+				case data[i] == quote:
+					break findtitleend
+
+				default:
+					i++
+				}
+			}
+
+			titleE = i
+			for i++; i < len(data) && isspace(data[i]); i++ {
+			}
+			if i >= len(data) || data[i] != ')' {
+				return 0
+			}
+		}
+
+		// remove whitespace at the end of the link
+		for linkE > linkB && isspace(data[linkE-1]) {
+			linkE--
+		}
+
+		// remove optional angle brackets around the link
+		if linkE > linkB && data[linkB] == '<' {
+			linkB++
+		}
+		if linkE > linkB && data[linkE-1] == '>' {
+			linkE--
+		}
+
+		if linkE > linkB {
+			link = data[linkB:linkE]
+		}
+
+		if titleE > titleB {
+			title = data[titleB:titleE]
+		}
+
+		i++
+
+	// reference style link: [text][id], or [id][] using the text as its id
+	case i < len(data) && data[i] == '[':
+		i++
+		linkB := i
+		for i < len(data) && data[i] != ']' {
+			i++
+		}
+		if i >= len(data) {
+			return 0
+		}
+		linkE := i
+
+		id := data[linkB:linkE]
+		if linkB == linkE {
+			id = data[1:txtE]
+		}
+
+		// find the reference with matching id
+		lr, ok := p.getRef(id)
+		if !ok {
+			return 0
+		}
+
+		// keep link and title from reference
+		link, title = lr.link, lr.title
+		if linkB == linkE {
+			altContent = lr.text
+		}
+		i++
+
+	// shortcut reference style link: [id]
+	default:
+		lr, ok := p.getRef(data[1:txtE])
+		if !ok {
+			return 0
+		}
+
+		link, title, altContent = lr.link, lr.title, lr.text
+		i = txtE + 1
+	}
+
+	// build content: img alt is escaped, link content is parsed
+	text := data[1:txtE]
+	if len(altContent) > 0 {
+		text = altContent
+	}
+
+	var content bytes.Buffer
+	if len(text) > 0 {
+		if t == linkImg {
+			content.Write(text)
+		} else {
+			// links cannot contain other links, so turn off link parsing
+			// temporarily and recurse
+			insideLink := p.insideLink
+			p.insideLink = true
+			p.inline(&content, text)
+			p.insideLink = insideLink
+		}
+	}
+
+	var uLink, uTitle bytes.Buffer
+	unescapeText(&uLink, link)
+	unescapeText(&uTitle, title)
+
+	// links need something to click on and somewhere to go
+	if uLink.Len() == 0 || (t == linkNormal && content.Len() == 0) {
+		return 0
+	}
+
+	// call the relevant rendering function
+	switch t {
+	case linkNormal:
+		p.span(data[:i])
+		p.r.Link(out, uLink.Bytes(), uTitle.Bytes(), content.Bytes())
+
+	case linkImg:
+		// the '!' has already been written out as normal text
+		outSize := out.Len()
+		outBytes := out.Bytes()
+		if outSize > 0 && outBytes[outSize-1] == '!' {
+			out.Truncate(outSize - 1)
+		}
+
+		p.spanAround(data[:i], 1)
+		p.r.Image(out, uLink.Bytes(), uTitle.Bytes(), content.Bytes())
+	}
+
+	return i
+}
+
+// footnoteRef renders a [^refId] footnote reference, numbering the footnote
+// the first time it is used. The id may hold anything a definition's may,
+// that is anything but a newline or a ']', except for a '[': stopping there
+// keeps a run of unclosed references from being scanned again and again.
+func footnoteRef(p *parser, out *bytes.Buffer, data []byte) int {
+	end := 2
+	for end < len(data) && data[end] != ']' && data[end] != '\n' && data[end] != '[' {
+		end++
+	}
+	if end >= len(data) || data[end] != ']' || end == 2 {
+		return 0
+	}
+
+	ref, ok := p.refs[refId(data[1:end])]
+	if !ok || ref.noteId == 0 {
+		return 0
+	}
+	if ref.noteId < 0 {
+		p.notes = append(p.notes, ref)
+		ref.noteId = len(p.notes)
+	}
+
+	p.span(data[:end+1])
+	p.r.FootnoteRef(out, ref.link, ref.noteId)
+	return end + 1
+}
+
+// '&': a named, decimal or hexadecimal character reference
+func entity(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+	data = data[offset:]
+
+	// the characters allowed in the reference, how many of them, and the
+	// base of a numeric one
+	var valid func(c byte) bool
+	var start, max, base int
+	switch {
+	case bytes.HasPrefix(data, []byte("&#x")), bytes.HasPrefix(data, []byte("&#X")):
+		valid, start, max, base = isxdigit, 3, 6, 16
+	case bytes.HasPrefix(data, []byte("&#")):
+		valid, start, max, base = isdigit, 2, 7, 10
+	case len(data) > 1 && isletter(data[1]):
+		valid, start, max = isalnum, 1, 32
+	default:
+		return 0
+	}
+
+	end := start
+	for end < len(data) && end-start < max && valid(data[end]) {
+		end++
+	}
+	if end == start || end >= len(data) || data[end] != ';' {
+		// a lone '&'
+		return 0
+	}
+
+	// a numeric reference has to stand for a character
+	if base != 0 {
+		code, _ := strconv.ParseUint(string(data[start:end]), base, 32)
+		if code == 0 || !utf8.ValidRune(rune(code)) {
+			return 0
+		}
+	}
+	end++
+
+	p.span(data[:end])
+	p.r.Entity(out, data[:end])
+	return end
+}
+
+// '<': an html tag, comment or an autolink in angle brackets
+func leftAngle(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+	data = data[offset:]
+	kind := LINK_TYPE_NOT_AUTOLINK
+	end := tagLength(data, &kind)
+	if end == 0 {
+		return 0
+	}
+
+	if kind != LINK_TYPE_NOT_AUTOLINK {
+		// no links inside links
+		if p.insideLink {
+			return 0
+		}
+		var uLink bytes.Buffer
+		unescapeText(&uLink, data[1:end-1])
+		p.span(data[:end])
+		p.r.AutoLink(out, uLink.Bytes(), kind)
+		return end
+	}
+
+	// don't autolink the text of a raw html link
+	if isHtmlTag(data[:end], "a") {
+		p.insideLink = data[1] != '/'
+	}
+
+	// the contents of a style element are no markdown, and go along with
+	// its tags
+	if isHtmlTag(data[:end], "style") && data[1] != '/' {
+		end += styleEnd(data[end:])
+	}
+	p.span(data[:end])
+	p.r.RawHtmlTag(out, data[:end])
+	return end
+}
+
+// tagLength returns the length of the html tag, comment or autolink in angle
+// brackets at the beginning of data, or 0 if there is none. kind is set to
+// the type of autolink found.
+func tagLength(data []byte, kind *int) int {
+	if len(data) < 3 || data[0] != '<' {
+		return 0
+	}
+
+	if bytes.HasPrefix(data, []byte("<!--")) {
+		return commentEnd(data)
+	}
+
+	i := 1
+	if data[1] == '/' {
+		i++
+	}
+	if i >= len(data) || !isletter(data[i]) {
+		return 0
+	}
+
+	// an autolink runs up to the '>' without any space in between
+	if i == 1 {
+		end := 1
+		for end < len(data) && data[end] != '>' && data[end] != '<' && !isspace(data[end]) {
+			end++
+		}
+		if end < len(data) && data[end] == '>' {
+			link := data[1:end]
+			switch {
+			case isMailtoAutoLink(link):
+				*kind = LINK_TYPE_EMAIL
+				return end + 1
+			case len(linkScheme(link)) > 1:
+				*kind = LINK_TYPE_NORMAL
+				return end + 1
+			}
+		}
+	}
+
+	// otherwise a tag name, then attributes up to the '>', without any
+	// other tag starting in between
+	for i < len(data) && (isalnum(data[i]) || data[i] == '-') {
+		i++
+	}
+	if i >= len(data) || (data[i] != '>' && data[i] != '/' && !isspace(data[i])) {
+		return 0
+	}
+	for i < len(data) && data[i] != '>' && data[i] != '<' {
+		// a quoted attribute value may hold a '>' or a '<'
+		if data[i] == '"' || data[i] == '\'' {
+			i = skipUntilChar(data, i+1, data[i])
+		}
+		i++
+	}
+	if i >= len(data) || data[i] != '>' {
+		return 0
+	}
+	return i + 1
+}
+
+// commentEnd returns the size of the html comment at the beginning of data,
+// or 0 if it is not closed. Comments do not nest, so the search for the end
+// gives up at the start of the next one.
+func commentEnd(data []byte) int {
+	for i := 4; i < len(data); i++ {
+		switch {
+		case bytes.HasPrefix(data[i:], []byte("-->")):
+			return i + 3
+		case bytes.HasPrefix(data[i:], []byte("<!--")):
+			return 0
+		}
+	}
+	return 0
+}
+
+// styleEnd returns the size of the contents and closing tag of the style
+// element whose opening tag comes before data, or 0 if it is not closed
+// before another one opens
+func styleEnd(data []byte) int {
+	for i := 0; i < len(data); i++ {
+		j := bytes.IndexByte(data[i:], '<')
+		if j < 0 {
+			return 0
+		}
+		i += j
+		switch {
+		case hasPrefixFold(data[i:], "</style>"):
+			return i + len("</style>")
+		case isHtmlTag(data[i:], "style"):
+			return 0
+		}
+	}
+	return 0
+}
+
+// isMailtoAutoLink tells whether link is an email address
+func isMailtoAutoLink(link []byte) bool {
+	at := bytes.IndexByte(link, '@')
+	if at <= 0 || at == len(link)-1 {
+		return false
+	}
+	for _, c := range link[:at] {
+		if !isEmailChar(c) {
+			return false
+		}
+	}
+	for _, c := range link[at+1:] {
+		if !isalnum(c) && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// rewindOutput removes the text that was written out as normal text before
+// an autolink trigger, provided the output still ends with it
+func rewindOutput(out *bytes.Buffer, text []byte) bool {
+	if !bytes.HasSuffix(out.Bytes(), text) {
+		return false
+	}
+	out.Truncate(out.Len() - len(text))
+	return true
+}
+
+// autoLinkEnd returns the length of link once trailing punctuation, and
+// closing parentheses without a match inside the link, are trimmed off
+func autoLinkEnd(link []byte) int {
+	end := len(link)
+	for end > 0 {
+		switch c := link[end-1]; {
+		case bytes.IndexByte([]byte(".,:;!?'\"*_~"), c) >= 0:
+			end--
+		case c == ')' && bytes.Count(link[:end], []byte("(")) < bytes.Count(link[:end], []byte(")")):
+			end--
+		default:
+			return end
+		}
+	}
+	return end
+}
+
+// ':' when autolinks are allowed: http://, https://, ftp:// and mailto: links
+func autoLink(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+	if p.insideLink {
+		return 0
+	}
+
+	// scan backward for the scheme, which must start a word
+	rewind := 0
+	for offset-rewind > 0 && rewind <= 6 && isletter(data[offset-rewind-1]) {
+		rewind++
+	}
+	if rewind == 0 || rewind > 6 {
+		return 0
+	}
+	start := offset - rewind
+	if start > 0 && (isalnum(data[start-1]) || data[start-1] == '/') {
+		return 0
+	}
+
+	kind := LINK_TYPE_NORMAL
+	prefix := 0
+	switch scheme := linkScheme(data[start:]); {
+	case scheme == "mailto":
+		kind = LINK_TYPE_EMAIL
+		prefix = len("mailto:")
+	case scheme != "http" && scheme != "https" && scheme != "ftp":
+		return 0
+	case !bytes.HasPrefix(data[offset:], []byte("://")):
+		return 0
+	}
+
+	linkEnd := start
+	for linkEnd < len(data) && !isspace(data[linkEnd]) && data[linkEnd] != '<' {
+		linkEnd++
+	}
+	linkEnd = start + autoLinkEnd(data[start:linkEnd])
+
+	// a link needs more than its scheme
+	if kind == LINK_TYPE_EMAIL && linkEnd-start-prefix < 3 {
+		return 0
+	}
+	if kind == LINK_TYPE_NORMAL && linkEnd <= offset+len("://") {
+		return 0
+	}
+
+	// we were triggered on the ':', so we need to rewind the output a bit
+	if !rewindOutput(out, data[start:offset]) {
+		return 0
+	}
+
+	var uLink bytes.Buffer
+	unescapeText(&uLink, data[start+prefix:linkEnd])
+	p.span(data[start:linkEnd])
+	p.r.AutoLink(out, uLink.Bytes(), kind)
+
+	return linkEnd - offset
+}
+
+// isEmailChar tells whether a character may appear in the local part of an
+// email address
+func isEmailChar(c byte) bool {
+	return isalnum(c) || c == '.' || c == '+' || c == '-' || c == '_'
+}
+
+// '@' when autolinks are allowed: bare email addresses
+func emailAutoLink(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+	if p.insideLink {
+		return 0
+	}
+
+	// scan backward for the local part
+	start := offset
+	for start > 0 && isEmailChar(data[start-1]) {
+		start--
+	}
+	if start == offset || (start > 0 && (data[start-1] == '/' || data[start-1] == ':')) {
+		return 0
+	}
+
+	// the domain is made of at least two dot separated labels
+	end, dots := offset+1, 0
+	for end < len(data) && (isalnum(data[end]) || data[end] == '-' || data[end] == '.') {
+		if data[end] == '.' {
+			dots++
+		}
+		end++
+	}
+	for end > offset+1 && (data[end-1] == '.' || data[end-1] == '-') {
+		if data[end-1] == '.' {
+			dots--
+		}
+		end--
+	}
+	if end == offset+1 || dots == 0 || data[offset+1] == '.' {
+		return 0
+	}
+
+	// we were triggered on the '@', so we need to rewind the output a bit
+	if !rewindOutput(out, data[start:offset]) {
+		return 0
+	}
+
+	p.span(data[start:end])
+	p.r.AutoLink(out, data[start:end], LINK_TYPE_EMAIL)
+
+	return end - offset
+}
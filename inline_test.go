@@ -9,6 +9,7 @@ package markdown
 
 import (
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -280,6 +281,15 @@ func TestCodeSpan(t *testing.T) {
 
 		"```multiple ticks `with` ticks inside```\n",
 		"<p><code>multiple ticks `with` ticks inside</code></p>\n",
+
+		"`<b>&copy;</b>`\n",
+		"<p><code>&lt;b&gt;&amp;copy;&lt;/b&gt;</code></p>\n",
+
+		"`a < b && c > \"d\"`\n",
+		"<p><code>a &lt; b &amp;&amp; c &gt; &quot;d&quot;</code></p>\n",
+
+		"`</code><script>`\n",
+		"<p><code>&lt;/code&gt;&lt;script&gt;</code></p>\n",
 	}
 	doTestsInline(t, tests)
 }
@@ -326,6 +336,575 @@ func TestLineBreak(t *testing.T) {
 	doTestsInlineParam(t, tests, opts, 0, HtmlRendererParameters{})
 }
 
+func TestInlineLink(t *testing.T) {
+	var tests = []string{
+		"[foo](/bar/)\n",
+		"<p><a href=\"/bar/\">foo</a></p>\n",
+
+		"[foo with a title](/bar/ \"title\")\n",
+		"<p><a href=\"/bar/\" title=\"title\">foo with a title</a></p>\n",
+
+		"[foo with a title](/bar/\t\"title\")\n",
+		"<p><a href=\"/bar/\" title=\"title\">foo with a title</a></p>\n",
+
+		"[foo with a title](/bar/ 'title with \"quotes\"')\n",
+		"<p><a href=\"/bar/\" title=\"title with &quot;quotes&quot;\">foo with a title</a></p>\n",
+
+		"[foo](<http://example.com/a b>)\n",
+		"<p><a href=\"http://example.com/a b\">foo</a></p>\n",
+
+		"[foo](/bar/(baz))\n",
+		"<p><a href=\"/bar/(baz)\">foo</a></p>\n",
+
+		"[foo](/bar\\)baz)\n",
+		"<p><a href=\"/bar)baz\">foo</a></p>\n",
+
+		"[*emphasised* text](/url)\n",
+		"<p><a href=\"/url\"><em>emphasised</em> text</a></p>\n",
+
+		"[link with \\] bracket](/url)\n",
+		"<p><a href=\"/url\">link with ] bracket</a></p>\n",
+
+		"[outer [inner](/inner) text](/outer)\n",
+		"<p><a href=\"/outer\">outer [inner](/inner) text</a></p>\n",
+
+		"[](/url)\n",
+		"<p>[](/url)</p>\n",
+
+		"[no url]()\n",
+		"<p>[no url]()</p>\n",
+
+		"[unclosed](/url\n",
+		"<p>[unclosed](/url</p>\n",
+
+		"[shortcut]\n",
+		"<p>[shortcut]</p>\n",
+
+		"[escaped & char](/url?a=1&b=2)\n",
+		"<p><a href=\"/url?a=1&amp;b=2\">escaped &amp; char</a></p>\n",
+
+		"[unclosed title](/url \"title)\n",
+		"<p>[unclosed title](/url &quot;title)</p>\n",
+
+		"[title](/url \"with ) paren\" )\n",
+		"<p><a href=\"/url\" title=\"with ) paren\">title</a></p>\n",
+
+		strings.Repeat("[", 20) + "deep" + strings.Repeat("]", 20) + "(/url)\n",
+		"<p>" + strings.Repeat("[", 20) + "deep" + strings.Repeat("]", 20) + "(/url)</p>\n",
+	}
+	doTestsInline(t, tests)
+}
+
+func TestInlineImage(t *testing.T) {
+	var tests = []string{
+		"![foo](/bar/)\n",
+		"<p><img src=\"/bar/\" alt=\"foo\" /></p>\n",
+
+		"![foo with a title](/bar/ \"title\")\n",
+		"<p><img src=\"/bar/\" alt=\"foo with a title\" title=\"title\" /></p>\n",
+
+		"![](/bar/)\n",
+		"<p><img src=\"/bar/\" alt=\"\" /></p>\n",
+
+		"text ![\"alt\"](/bar/) text\n",
+		"<p>text <img src=\"/bar/\" alt=\"&quot;alt&quot;\" /> text</p>\n",
+
+		"\\![not an image](/bar/)\n",
+		"<p>!<a href=\"/bar/\">not an image</a></p>\n",
+
+		"[![image in a link](/img.png)](/url)\n",
+		"<p><a href=\"/url\"><img src=\"/img.png\" alt=\"image in a link\" /></a></p>\n",
+	}
+	doTestsInline(t, tests)
+}
+
+func TestLinkHtmlFlags(t *testing.T) {
+	var tests = []string{
+		"[foo](/bar/) ![img](/img.png)\n",
+		"<p>foo <img src=\"/img.png\" alt=\"img\" /></p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{}, HTML_SKIP_LINKS, HtmlRendererParameters{})
+
+	tests = []string{
+		"[foo](/bar/) ![img](/img.png)\n",
+		"<p><a href=\"/bar/\">foo</a> </p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{}, HTML_SKIP_IMAGES, HtmlRendererParameters{})
+
+	tests = []string{
+		"[foo](javascript:alert(1))\n",
+		"<p>foo</p>\n",
+
+		"[foo](http://example.com/)\n",
+		"<p><a href=\"http://example.com/\">foo</a></p>\n",
+
+		"[foo](mailto:bob@example.com)\n",
+		"<p><a href=\"mailto:bob@example.com\">foo</a></p>\n",
+
+		"[foo](../bar/)\n",
+		"<p><a href=\"../bar/\">foo</a></p>\n",
+
+		"[a](java\nscript:alert(1))\n",
+		"<p>a</p>\n",
+
+		"[a](< javascript:alert(1)>)\n",
+		"<p>a</p>\n",
+
+		"[a](<\x01javascript:alert(1)>)\n",
+		"<p>a</p>\n",
+
+		"![x](javascript:alert(1))\n",
+		"<p>x</p>\n",
+
+		"![x](/img.png)\n",
+		"<p><img src=\"/img.png\" alt=\"x\" /></p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{}, HTML_SAFELINK, HtmlRendererParameters{})
+
+	tests = []string{
+		"[foo](http://example.com/)\n",
+		"<p><a href=\"http://example.com/\" rel=\"nofollow noreferrer\" target=\"_blank\">foo</a></p>\n",
+
+		"[foo](/bar/)\n",
+		"<p><a href=\"/bar/\">foo</a></p>\n",
+
+		"[foo](//example.com/)\n",
+		"<p><a href=\"//example.com/\" rel=\"nofollow noreferrer\" target=\"_blank\">foo</a></p>\n",
+	}
+	flags := HTML_NOFOLLOW_LINKS | HTML_NOREFERRER_LINKS | HTML_HREF_TARGET_BLANK
+	doTestsInlineParam(t, tests, Options{}, flags, HtmlRendererParameters{})
+}
+
+func TestLinkAbsolutePrefix(t *testing.T) {
+	var tests = []string{
+		"[foo](/bar/)\n",
+		"<p><a href=\"http://localhost/bar/\">foo</a></p>\n",
+
+		"[foo](bar.html)\n",
+		"<p><a href=\"http://localhost/bar.html\">foo</a></p>\n",
+
+		"[foo](#anchor)\n",
+		"<p><a href=\"#anchor\">foo</a></p>\n",
+
+		"[foo](./bar.html)\n",
+		"<p><a href=\"./bar.html\">foo</a></p>\n",
+
+		"[foo](http://example.com/)\n",
+		"<p><a href=\"http://example.com/\">foo</a></p>\n",
+
+		"![foo](/img.png)\n",
+		"<p><img src=\"http://localhost/img.png\" alt=\"foo\" /></p>\n",
+	}
+	params := HtmlRendererParameters{AbsolutePrefix: "http://localhost"}
+	doTestsInlineParam(t, tests, Options{}, 0, params)
+}
+
+func TestReferenceLink(t *testing.T) {
+	var tests = []string{
+		"[link][ref]\n\n[ref]: /url/ \"title\"\n",
+		"<p><a href=\"/url/\" title=\"title\">link</a></p>\n",
+
+		"[link][ref]\n\n   [ref]: /url/ 'title'\n",
+		"<p><a href=\"/url/\" title=\"title\">link</a></p>\n",
+
+		"[link][ref]\n\n[ref]: </url/> (title)\n",
+		"<p><a href=\"/url/\" title=\"title\">link</a></p>\n",
+
+		"[link][ref]\n\n[ref]: /url/\n    \"title on the next line\"\n",
+		"<p><a href=\"/url/\" title=\"title on the next line\">link</a></p>\n",
+
+		"[link][REF]\n\n[Ref]: /url/\n",
+		"<p><a href=\"/url/\">link</a></p>\n",
+
+		"[Ref][]\n\n[ref]: /url/\n",
+		"<p><a href=\"/url/\">Ref</a></p>\n",
+
+		"[ref]\n\n[ref]: /url/\n",
+		"<p><a href=\"/url/\">ref</a></p>\n",
+
+		"[multi\nline][]\n\n[multi line]: /url/\n",
+		"<p><a href=\"/url/\">multi\nline</a></p>\n",
+
+		"![image][ref]\n\n[ref]: /img.png\n",
+		"<p><img src=\"/img.png\" alt=\"image\" /></p>\n",
+
+		"[link][missing]\n",
+		"<p>[link][missing]</p>\n",
+
+		"[ref]: /url/ junk\n",
+		"<p>[ref]: /url/ junk</p>\n",
+	}
+	doTestsInline(t, tests)
+
+	// references are not extracted from fenced code blocks
+	tests = []string{
+		"```\n[ref]: /url/\n```\n[ref]\n",
+		"<pre><code>[ref]: /url/\n</code></pre>\n\n<p>[ref]</p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{Extensions: EXTENSION_FENCED_CODE}, 0, HtmlRendererParameters{})
+}
+
+func TestReferenceOverride(t *testing.T) {
+	var tests = []string{
+		"test [ref1][]\n",
+		"<p>test <a href=\"http://www.ref1.com/\" title=\"Reference 1\">ref1</a></p>\n",
+
+		"test [my ref][ref1]\n",
+		"<p>test <a href=\"http://www.ref1.com/\" title=\"Reference 1\">my ref</a></p>\n",
+
+		"test [JIRA-123]\n",
+		"<p>test <a href=\"https://jira.example.com/browse/JIRA-123\">JIRA-123</a></p>\n",
+
+		"test [ref2][]\n",
+		"<p>test <a href=\"http://www.ref2.com/\" title=\"Reference 2\">Reference 2 <em>text</em></a></p>\n",
+
+		"test [ref3][]\n\n[ref3]: http://www.ref3.com/ \"Reference 3\"\n",
+		"<p>test [ref3][]</p>\n",
+
+		"test [ref4][]\n\n[ref4]: http://zombo.com/ \"You can do anything\"\n",
+		"<p>test <a href=\"http://zombo.com/\" title=\"You can do anything\">ref4</a></p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{
+		ReferenceOverride: func(reference string) (rv *Reference, overridden bool) {
+			switch {
+			case reference == "ref1":
+				// just an overriden reference exists without definition
+				return &Reference{
+					Link:  "http://www.ref1.com/",
+					Title: "Reference 1"}, true
+			case reference == "ref2":
+				// overriden reference with a replacement text
+				return &Reference{
+					Link:  "http://www.ref2.com/",
+					Title: "Reference 2",
+					Text:  "Reference 2 *text*"}, true
+			case reference == "ref3":
+				// a vetoed reference is not resolved, even if defined
+				return nil, true
+			case strings.HasPrefix(reference, "JIRA-"):
+				return &Reference{
+					Link: "https://jira.example.com/browse/" + reference}, true
+			}
+			return nil, false
+		}}, 0, HtmlRendererParameters{})
+}
+
+func TestFootnotes(t *testing.T) {
+	var tests = []string{
+		"testing footnotes.[^a]\n\n[^a]: This is the note\n",
+		"<p>testing footnotes.<sup class=\"footnote-ref\" id=\"fnref:a\"><a rel=\"footnote\" href=\"#fn:a\">1</a></sup></p>\n\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:a\">This is the note</li>\n</ol>\n</div>\n",
+
+		"second[^b] first[^a] second again[^b]\n\n[^a]: Note A\n[^b]: Note B\n",
+		"<p>second<sup class=\"footnote-ref\" id=\"fnref:b\"><a rel=\"footnote\" href=\"#fn:b\">1</a></sup>" +
+			" first<sup class=\"footnote-ref\" id=\"fnref:a\"><a rel=\"footnote\" href=\"#fn:a\">2</a></sup>" +
+			" second again<sup class=\"footnote-ref\" id=\"fnref:b:2\"><a rel=\"footnote\" href=\"#fn:b\">1</a></sup></p>\n\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:b\">Note B</li>\n<li id=\"fn:a\">Note A</li>\n</ol>\n</div>\n",
+
+		"multi[^m]\n\n[^m]: First paragraph\n\n    Second paragraph\n\n\t    code\n\nafter\n",
+		"<p>multi<sup class=\"footnote-ref\" id=\"fnref:m\"><a rel=\"footnote\" href=\"#fn:m\">1</a></sup></p>\n\n<p>after</p>\n\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:m\"><p>First paragraph</p>\n\n<p>Second paragraph</p>\n\n" +
+			"<pre><code>code\n</code></pre></li>\n</ol>\n</div>\n",
+
+		"nested[^1]\n\n[^1]: see[^2]\n[^2]: the nested note\n",
+		"<p>nested<sup class=\"footnote-ref\" id=\"fnref:1\"><a rel=\"footnote\" href=\"#fn:1\">1</a></sup></p>\n\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n" +
+			"<li id=\"fn:1\">see<sup class=\"footnote-ref\" id=\"fnref:2\"><a rel=\"footnote\" href=\"#fn:2\">2</a></sup></li>\n" +
+			"<li id=\"fn:2\">the nested note</li>\n</ol>\n</div>\n",
+
+		"[^a] is not [a]\n\n[^a]: note\n[a]: /link\n",
+		"<p><sup class=\"footnote-ref\" id=\"fnref:a\"><a rel=\"footnote\" href=\"#fn:a\">1</a></sup> is not <a href=\"/link\">a</a></p>\n\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:a\">note</li>\n</ol>\n</div>\n",
+
+		"missing[^x]\n",
+		"<p>missing[^x]</p>\n",
+
+		"unused note\n\n[^u]: never referenced\n",
+		"<p>unused note</p>\n",
+
+		"spaced[^x  y]\n\n[^x y]: note\n",
+		"<p>spaced<sup class=\"footnote-ref\" id=\"fnref:x-y\"><a rel=\"footnote\" href=\"#fn:x-y\">1</a></sup></p>\n\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:x-y\">note</li>\n</ol>\n</div>\n",
+
+		"clash[^a b] and[^a-b]\n\n[^a b]: one\n[^a-b]: two\n",
+		"<p>clash<sup class=\"footnote-ref\" id=\"fnref:a-b\"><a rel=\"footnote\" href=\"#fn:a-b\">1</a></sup>" +
+			" and<sup class=\"footnote-ref\" id=\"fnref:a-b-1\"><a rel=\"footnote\" href=\"#fn:a-b-1\">2</a></sup></p>\n\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:a-b\">one</li>\n<li id=\"fn:a-b-1\">two</li>\n</ol>\n</div>\n",
+
+		"open [^[^a]\n\n[^a]: note\n",
+		"<p>open [^<sup class=\"footnote-ref\" id=\"fnref:a\"><a rel=\"footnote\" href=\"#fn:a\">1</a></sup></p>\n\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:a\">note</li>\n</ol>\n</div>\n",
+	}
+	doTestsInlineParam(t, tests, Options{Extensions: EXTENSION_FOOTNOTES}, 0, HtmlRendererParameters{})
+
+	tests = []string{
+		"testing footnotes.[^a]\n\n[^a]: This is the note\n",
+		"<p>testing footnotes.<sup class=\"footnote-ref\" id=\"fnref:pre:a\"><a rel=\"footnote\" href=\"#fn:pre:a\">1</a></sup></p>\n\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:pre:a\">This is the note" +
+			" <a class=\"footnote-return\" href=\"#fnref:pre:a\">back</a></li>\n</ol>\n</div>\n",
+	}
+	params := HtmlRendererParameters{
+		FootnoteAnchorPrefix:       "pre:",
+		FootnoteReturnLinkContents: "back",
+	}
+	doTestsInlineParam(t, tests, Options{Extensions: EXTENSION_FOOTNOTES}, HTML_FOOTNOTE_RETURN_LINKS, params)
+
+	// without the extension, footnotes are plain text
+	tests = []string{
+		"testing footnotes.[^a]\n\n[^a]: This is the note\n",
+		"<p>testing footnotes.[^a]</p>\n\n<p>[^a]: This is the note</p>\n",
+	}
+	doTestsInline(t, tests)
+}
+
+func TestAutoLink(t *testing.T) {
+	var tests = []string{
+		"http://foo.com/\n",
+		"<p><a href=\"http://foo.com/\">http://foo.com/</a></p>\n",
+
+		"1 http://foo.com/\n",
+		"<p>1 <a href=\"http://foo.com/\">http://foo.com/</a></p>\n",
+
+		"a secure https://link.org\n",
+		"<p>a secure <a href=\"https://link.org\">https://link.org</a></p>\n",
+
+		"an ftp://files.example.com/ link\n",
+		"<p>an <a href=\"ftp://files.example.com/\">ftp://files.example.com/</a> link</p>\n",
+
+		"See http://example.com/?a=1&b=2.\n",
+		"<p>See <a href=\"http://example.com/?a=1&amp;b=2\">http://example.com/?a=1&amp;b=2</a>.</p>\n",
+
+		"Is it http://example.com/?\n",
+		"<p>Is it <a href=\"http://example.com/\">http://example.com/</a>?</p>\n",
+
+		"foo http://www.pokemon.com/Pikachu_(Electric) bar\n",
+		"<p>foo <a href=\"http://www.pokemon.com/Pikachu_(Electric)\">http://www.pokemon.com/Pikachu_(Electric)</a> bar</p>\n",
+
+		"foo (http://www.pokemon.com/Pikachu_(Electric)) bar\n",
+		"<p>foo (<a href=\"http://www.pokemon.com/Pikachu_(Electric)\">http://www.pokemon.com/Pikachu_(Electric)</a>) bar</p>\n",
+
+		"*see http://example.com*\n",
+		"<p><em>see <a href=\"http://example.com\">http://example.com</a></em></p>\n",
+
+		"mailto:bob@example.com\n",
+		"<p><a href=\"mailto:bob@example.com\">bob@example.com</a></p>\n",
+
+		"write to bob.smith+tag@example.co.uk, please\n",
+		"<p>write to <a href=\"mailto:bob.smith+tag@example.co.uk\">bob.smith+tag@example.co.uk</a>, please</p>\n",
+
+		"first_last@example.com\n",
+		"<p><a href=\"mailto:first_last@example.com\">first_last@example.com</a></p>\n",
+
+		"user@localhost and @handle and a@b.\n",
+		"<p>user@localhost and @handle and a@b.</p>\n",
+
+		"xhttp://foo.com/ and http:// alone\n",
+		"<p>xhttp://foo.com/ and http:// alone</p>\n",
+
+		"javascript:alert(1)\n",
+		"<p>javascript:alert(1)</p>\n",
+
+		"`http://foo.com/`\n",
+		"<p><code>http://foo.com/</code></p>\n",
+
+		"[http://foo.com/](http://bar.com/)\n",
+		"<p><a href=\"http://bar.com/\">http://foo.com/</a></p>\n",
+
+		"[bob@example.com](http://bar.com/)\n",
+		"<p><a href=\"http://bar.com/\">bob@example.com</a></p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{Extensions: EXTENSION_AUTOLINK}, 0, HtmlRendererParameters{})
+
+	tests = []string{
+		"http://foo.com/ and bob@example.com\n",
+		"<p><a href=\"http://foo.com/\" rel=\"nofollow\" target=\"_blank\">http://foo.com/</a>" +
+			" and <a href=\"mailto:bob@example.com\">bob@example.com</a></p>\n",
+	}
+	flags := HTML_NOFOLLOW_LINKS | HTML_HREF_TARGET_BLANK
+	doTestsInlineParam(t, tests, Options{Extensions: EXTENSION_AUTOLINK}, flags, HtmlRendererParameters{})
+
+	// without the extension, nothing is linked
+	tests = []string{
+		"http://foo.com/ and bob@example.com\n",
+		"<p>http://foo.com/ and bob@example.com</p>\n",
+	}
+	doTestsInline(t, tests)
+}
+
+func TestRawHtmlTag(t *testing.T) {
+	var tests = []string{
+		"a <b>bold</b> word\n",
+		"<p>a <b>bold</b> word</p>\n",
+
+		"<span title=\"a>b\">x</span>\n",
+		"<p><span title=\"a>b\">x</span></p>\n",
+
+		"text <!-- inline comment --> more\n",
+		"<p>text <!-- inline comment --> more</p>\n",
+
+		"a < b and <3 and <not a tag\n",
+		"<p>a &lt; b and &lt;3 and &lt;not a tag</p>\n",
+
+		"[<b>x</b>](http://y.com)\n",
+		"<p><a href=\"http://y.com\"><b>x</b></a></p>\n",
+
+		"<http://foo.com/?a=b&c> and <bob@example.com>\n",
+		"<p><a href=\"http://foo.com/?a=b&amp;c\">http://foo.com/?a=b&amp;c</a>" +
+			" and <a href=\"mailto:bob@example.com\">bob@example.com</a></p>\n",
+
+		"<mailto:bob@example.com>\n",
+		"<p><a href=\"mailto:bob@example.com\">mailto:bob@example.com</a></p>\n",
+
+		"<a:b> is not a link\n",
+		"<p>&lt;a:b&gt; is not a link</p>\n",
+
+		"x <style>p > *{}</style> y\n",
+		"<p>x <style>p > *{}</style> y</p>\n",
+
+		"<a <b>c</b>\n",
+		"<p>&lt;a <b>c</b></p>\n",
+
+		"<!-- one <!-- two -->\n",
+		"<p>&lt;!-- one <!-- two --></p>\n",
+	}
+	doTestsInline(t, tests)
+
+	// bare urls are left alone in the text of a raw html link
+	tests = []string{
+		"<a href=\"http://x.com/\">http://x.com/</a> http://y.com/\n",
+		"<p><a href=\"http://x.com/\">http://x.com/</a> <a href=\"http://y.com/\">http://y.com/</a></p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{Extensions: EXTENSION_AUTOLINK}, 0, HtmlRendererParameters{})
+}
+
+func TestRawHtmlTagSkipFlags(t *testing.T) {
+	var tests = []string{
+		"a <b>c</b> <img src=\"d.png\">\n",
+		"<p>a c </p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{}, HTML_SKIP_HTML, HtmlRendererParameters{})
+
+	tests = []string{
+		"<img src=\"a.png\"> <a href=\"x\">y</a> <style>z</style> <b>c</b>\n",
+		"<p> y  <b>c</b></p>\n",
+
+		"x <STYLE>p{}\n*q*</Style> y\n",
+		"<p>x  y</p>\n",
+	}
+	flags := HTML_SKIP_STYLE | HTML_SKIP_LINKS | HTML_SKIP_IMAGES
+	doTestsInlineParam(t, tests, Options{}, flags, HtmlRendererParameters{})
+
+	tests = []string{
+		"<a href=\"x\">y</a> <img src=\"a.png\">\n",
+		"<p>y <img src=\"a.png\"></p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{}, HTML_SKIP_LINKS, HtmlRendererParameters{})
+}
+
+func TestEntity(t *testing.T) {
+	var tests = []string{
+		"&copy; 2016 &amp; &nbsp; &NotEqualTilde; &semi;\n",
+		"<p>&copy; 2016 &amp; &nbsp; &NotEqualTilde; &semi;</p>\n",
+
+		"&#169; &#x00A9; &#XA9;\n",
+		"<p>&#169; &#x00A9; &#XA9;</p>\n",
+
+		"&#12345678; &#x1234567; &#; &#x; &#xg;\n",
+		"<p>&amp;#12345678; &amp;#x1234567; &amp;#; &amp;#x; &amp;#xg;</p>\n",
+
+		"&#0; &#x0; &#xD800; &#55296; &#xDFFF; &#x110000; &#9999999;\n",
+		"<p>&amp;#0; &amp;#x0; &amp;#xD800; &amp;#55296; &amp;#xDFFF; &amp;#x110000; &amp;#9999999;</p>\n",
+
+		"&#xD7FF; &#xE000; &#x10FFFF; &#1114111;\n",
+		"<p>&#xD7FF; &#xE000; &#x10FFFF; &#1114111;</p>\n",
+
+		"&foo; &copyx; &copy &; & x &1a; &a-b;\n",
+		"<p>&amp;foo; &amp;copyx; &amp;copy &amp;; &amp; x &amp;1a; &amp;a-b;</p>\n",
+
+		"\\&copy; [&copy;](/legal)\n",
+		"<p>&amp;copy; <a href=\"/legal\">&copy;</a></p>\n",
+	}
+	doTestsInline(t, tests)
+}
+
+func TestSmartypants(t *testing.T) {
+	var tests = []string{
+		"\"Hello,\" she said. 'Don't you've it?'\n",
+		"<p>&ldquo;Hello,&rdquo; she said. &lsquo;Don&rsquo;t you&rsquo;ve it?&rsquo;</p>\n",
+
+		"''double'' quotes\n",
+		"<p>&ldquo;double&rdquo; quotes</p>\n",
+
+		"*\"emph\"* and \"[link](/a)\"\n",
+		"<p><em>&ldquo;emph&rdquo;</em> and &ldquo;<a href=\"/a\">link</a>&rdquo;</p>\n",
+
+		"Wait... and . . . (c) (R) (tm) a & b\n",
+		"<p>Wait&hellip; and &hellip; &copy; &reg; &trade; a &amp; b</p>\n",
+
+		"a - b -- c well-known\n",
+		"<p>a - b -- c well-known</p>\n",
+
+		"1/2 1/4 3/4 1/4th 2/3 1/23/2005\n",
+		"<p>&frac12; &frac14; &frac34; &frac14;th 2/3 1/23/2005</p>\n",
+
+		"`\"code\"`\n",
+		"<p><code>&quot;code&quot;</code></p>\n",
+
+		// an unsure quote does not depend on the list items, cells or
+		// footnotes ahead of it
+		"a \" b\n\n* c \" d\n* e \" f\n",
+		"<p>a &ldquo; b</p>\n\n<ul>\n<li>c &ldquo; d</li>\n<li>e &ldquo; f</li>\n</ul>\n",
+
+		"| a \" b | c \" d |\n|---|---|\n| e \" f | g \" h |\n",
+		"<table>\n<thead>\n<tr>\n<th>a &ldquo; b</th>\n<th>c &ldquo; d</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>e &ldquo; f</td>\n<td>g &ldquo; h</td>\n</tr>\n</tbody>\n</table>\n",
+
+		"x[^1] y[^2]\n\n[^1]: a \" b\n[^2]: c \" d\n",
+		"<p>x<sup class=\"footnote-ref\" id=\"fnref:1\"><a rel=\"footnote\" href=\"#fn:1\">1</a></sup> " +
+			"y<sup class=\"footnote-ref\" id=\"fnref:2\"><a rel=\"footnote\" href=\"#fn:2\">2</a></sup></p>\n\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:1\">a &ldquo; b</li>\n<li id=\"fn:2\">c &ldquo; d</li>\n</ol>\n</div>\n",
+	}
+	doTestsInlineParam(t, tests, Options{Extensions: EXTENSION_TABLES | EXTENSION_FOOTNOTES}, HTML_USE_SMARTYPANTS, HtmlRendererParameters{})
+
+	// without HTML_USE_SMARTYPANTS the other flags do nothing
+	tests = []string{
+		"\"quoted\" -- 1/2\n",
+		"<p>&quot;quoted&quot; -- 1/2</p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{}, HTML_SMARTYPANTS_DASHES|HTML_SMARTYPANTS_FRACTIONS, HtmlRendererParameters{})
+}
+
+func TestSmartypantsDashes(t *testing.T) {
+	var tests = []string{
+		"a - b -- c well-known\n",
+		"<p>a &ndash; b &mdash; c well-known</p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{}, HTML_USE_SMARTYPANTS|HTML_SMARTYPANTS_DASHES, HtmlRendererParameters{})
+
+	tests = []string{
+		"a - b -- c --- d well-known\n",
+		"<p>a - b &ndash; c &mdash; d well-known</p>\n",
+	}
+	flags := HTML_USE_SMARTYPANTS | HTML_SMARTYPANTS_DASHES | HTML_SMARTYPANTS_LATEX_DASHES
+	doTestsInlineParam(t, tests, Options{}, flags, HtmlRendererParameters{})
+}
+
+func TestSmartypantsFractions(t *testing.T) {
+	var tests = []string{
+		"1/2 2/3 12/25 1/4th 1/23/2005\n",
+		"<p><sup>1</sup>&frasl;<sub>2</sub> <sup>2</sup>&frasl;<sub>3</sub> <sup>12</sup>&frasl;<sub>25</sub> 1/4th 1/23/2005</p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{}, HTML_USE_SMARTYPANTS|HTML_SMARTYPANTS_FRACTIONS, HtmlRendererParameters{})
+}
+
+func TestSmartypantsAngledQuotes(t *testing.T) {
+	var tests = []string{
+		"\"Hello,\" she said. 'Hi'\n",
+		"<p>&laquo;Hello,&raquo; she said. &lsquo;Hi&rsquo;</p>\n",
+	}
+	doTestsInlineParam(t, tests, Options{}, HTML_USE_SMARTYPANTS|HTML_SMARTYPANTS_ANGLED_QUOTES, HtmlRendererParameters{})
+}
+
 //
 //
 // Unit TestCases
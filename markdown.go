@@ -15,6 +15,13 @@ package markdown
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
 )
 
 const VERSION = "0.1"
@@ -58,6 +65,33 @@ const (
 		EXTENSION_DEFINITION_LISTS
 )
 
+// These are the possible flag values for the list and list item renderers.
+// Multiple flag values may be ORed together.
+const (
+	LIST_TYPE_ORDERED        = 1 << iota
+	LIST_TYPE_DEFINITION     // a definition list, made of terms and their definitions
+	LIST_TYPE_TERM           // the item is a term of a definition list
+	LIST_ITEM_CONTAINS_BLOCK // the list is loose: items hold block content
+	LIST_ITEM_BEGINNING_OF_LIST
+	LIST_ITEM_END_OF_LIST
+)
+
+// These are the possible flag values for the autolink renderer.
+// Only a single one of these values will be used; they are not ORed together.
+const (
+	LINK_TYPE_NOT_AUTOLINK = iota
+	LINK_TYPE_NORMAL
+	LINK_TYPE_EMAIL // the link is a bare email address, without "mailto:"
+)
+
+// These are the possible flag values for the table cell renderer.
+// Only a single one of these values will be used; they are not ORed together.
+const (
+	TABLE_ALIGNMENT_LEFT = 1 << iota
+	TABLE_ALIGNMENT_RIGHT
+	TABLE_ALIGNMENT_CENTER = (TABLE_ALIGNMENT_LEFT | TABLE_ALIGNMENT_RIGHT)
+)
+
 // The size of a tab stop.
 const (
 	TAB_SIZE_DEFAULT = 4
@@ -72,12 +106,29 @@ const (
 // Currently Html implementation is provided
 type Renderer interface {
 	// block-level callbacks
-	//	BlockCode(out *bytes.Buffer, text []byte, lang string)
-	//	BlockQuote(out *bytes.Buffer, text []byte)
+	// BlockCode receives the info string of a fenced block as lang; its first
+	// word names the language. lang is empty for indented blocks.
+	BlockCode(out *bytes.Buffer, text []byte, lang string)
+	BlockQuote(out *bytes.Buffer, text []byte)
+	BlockHtml(out *bytes.Buffer, text []byte)
 	Header(out *bytes.Buffer, text func() bool, level int, id string)
+	// TitleBlock receives the fields of a title block, one per line: the
+	// title, the authors and the date. It is called before DocumentHeader.
+	TitleBlock(out *bytes.Buffer, text []byte)
+	HRule(out *bytes.Buffer)
+	// start is the number of the first item of an ordered list
+	List(out *bytes.Buffer, text func() bool, flags, start int)
+	ListItem(out *bytes.Buffer, text []byte, flags int)
 	Paragraph(out *bytes.Buffer, text func() bool)
+	Table(out *bytes.Buffer, header []byte, body []byte, columnData []int)
+	TableRow(out *bytes.Buffer, text []byte)
+	TableHeaderCell(out *bytes.Buffer, text []byte, flags int)
+	TableCell(out *bytes.Buffer, text []byte, flags int)
+	Footnotes(out *bytes.Buffer, text func() bool)
+	FootnoteItem(out *bytes.Buffer, name, text []byte, flags int)
 
 	// span-level callbacks
+	AutoLink(out *bytes.Buffer, link []byte, kind int)
 	//	CodeSpan(out *bytes.Buffer, text []byte)
 	Emphasis(out *bytes.Buffer, text []byte)
 	DoubleEmphasis(out *bytes.Buffer, text []byte)
@@ -85,9 +136,14 @@ type Renderer interface {
 	StrikeThrough(out *bytes.Buffer, text []byte)
 	CodeSpan(out *bytes.Buffer, text []byte)
 	LineBreak(out *bytes.Buffer)
+	Link(out *bytes.Buffer, link []byte, title []byte, content []byte)
+	Image(out *bytes.Buffer, link []byte, title []byte, alt []byte)
+	RawHtmlTag(out *bytes.Buffer, tag []byte)
+	FootnoteRef(out *bytes.Buffer, ref []byte, id int)
 
 	// Low-level callbacks
-	NormalText(out *bytes.Buffer, entity []byte)
+	Entity(out *bytes.Buffer, entity []byte)
+	NormalText(out *bytes.Buffer, text []byte)
 
 	// Header and footer
 	DocumentHeader(out *bytes.Buffer)
@@ -96,6 +152,16 @@ type Renderer interface {
 	GetFlags() int
 }
 
+// WholeDocumentRenderer is a Renderer that may need to see the whole
+// document before any of its output is final, as Html does when it puts a
+// table of contents ahead of the blocks it lists. Render holds back the
+// output of such a renderer until the end while NeedsWholeDocument returns
+// true, and streams the output of any other Renderer.
+type WholeDocumentRenderer interface {
+	Renderer
+	NeedsWholeDocument() bool
+}
+
 // Callback functions for inline parsing. One such function is defined
 // for each character that triggers a response when parsing inline data
 type inlineParser func(p *parser, out *bytes.Buffer, data []byte, offset int) int
@@ -111,8 +177,195 @@ type parser struct {
 	maxNesting     int
 	insideLink     bool
 	notes          []*reference
+
+	// source positions, only tracked for a PositionRenderer or to find
+	// where the parser broke down
+	pr      PositionRenderer
+	lines   *lineIndex
+	sources map[*byte]*sourceMap
+	at      []byte // the part of a buffer being parsed
+	moves   int    // how many times at moved on
+	stopAt  int    // the move locate stops the parser at, if any
+	first   []byte // the input as firstRender leaves it
+
+	// the limits of Options, and how far rendering got within them
+	maxInputSize   int
+	maxOutputSize  int
+	maxInlineCalls int
+	inlineCalls    int
+	marker         string
+	strict         bool   // whether errors can be reported
+	overflow       []byte // the input beyond MaxInputSize
+	stopped        bool   // whether rendering stopped short of the end
+	outgrown       bool   // whether it stopped inside a block too large
+
+	// the top-level blocks: the buffer they are rendered to, where the
+	// last one starts in it and in the input, and how much of them has
+	// been written out already
+	top       *bytes.Buffer
+	mark      int
+	markInput []byte
+	written   int
+
+	// streamed output, only set up by Render
+	w   io.Writer
+	err error // the first error writing to w
+
+	// the context of MarkdownContext, and the steps taken since it was
+	// last looked at
+	ctx   context.Context
+	steps int
+}
+
+// the number of steps of the block and inline loops, or of lines scanned,
+// between two looks at the context of MarkdownContext
+const contextInterval = 256
+
+// canceled is what the parser panics with when its context is done
+type canceled struct {
+	err error
+}
+
+// These are the ways the parser can break down, as found in the Err field
+// of an Error. Any other failure, such as an index out of range, is passed
+// along as is.
+var (
+	ErrMissingNewline = errors.New("block input is missing terminating newline")
+	ErrNesting        = errors.New("nesting level did not end at zero")
+)
+
+// These are the errors for going over the limits set in Options.
+var (
+	ErrTooDeep            = errors.New("elements nested too deeply")
+	ErrInputTooLarge      = errors.New("input too large")
+	ErrOutputTooLarge     = errors.New("output too large")
+	ErrTooManyInlineCalls = errors.New("too much inline markup")
+)
+
+// Error is the error MarkdownErr, MarkdownContext and Render return when
+// the parser breaks down on some input.
+type Error struct {
+	Err      error    // what went wrong
+	Position Position // where in the input the parser was, if known
+}
+
+func (e *Error) Error() string {
+	if e.Position.Line == 0 {
+		return fmt.Sprintf("markdown: %v", e.Err)
+	}
+	return fmt.Sprintf("markdown: line %d, column %d: %v", e.Position.Line, e.Position.Column, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
 }
 
+// catch turns the parser breaking down on input into an *Error in err. It
+// has to be deferred.
+func (p *parser) catch(err *error, input []byte, opts Options) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if c, ok := r.(canceled); ok {
+		*err = c.err
+		return
+	}
+	cause, ok := r.(error)
+	if !ok {
+		cause = fmt.Errorf("%v", r)
+	}
+	failure := &Error{Err: cause}
+	switch {
+	case p.sources != nil:
+		failure.Position = p.position(p.at)
+	case p.at == nil && p.moves > 0:
+		// it broke down past the blocks, as on the footnotes or the footer
+	default:
+		offset := -1
+		if sourceKey(p.at) != nil && sourceKey(p.at) == sourceKey(p.first) {
+			offset = cap(p.first) - cap(p.at)
+		}
+		failure.Position = locate(input, opts, p.ctx, p.moves, offset)
+	}
+	*err = failure
+}
+
+// locate parses input again, this time tracking source positions, to find
+// where the parser broke down on it: at the given offset of the input as
+// firstRender leaves it, if not negative, or else where it had moved on to
+// after moves moves. Tracking them for every input would cost too much for
+// the sake of the few the parser breaks down on. The parse renders to a
+// nopRenderer, so that the renderer of the first one sees each callback
+// once, and it stops where the first one did.
+func locate(input []byte, opts Options, ctx context.Context, moves, offset int) (pos Position) {
+	p := newParser(input, nopRenderer{}, opts)
+	p.trackSources(input)
+	p.strict = true
+	p.ctx = ctx
+	p.stopAt = moves
+	found := func() Position {
+		if offset >= 0 && offset <= len(p.first) {
+			return p.position(p.first[offset:])
+		}
+		return p.position(p.at)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(canceled); !ok {
+				pos = found()
+			}
+		}
+	}()
+
+	p.render(input)
+	if moves > 0 || offset >= 0 {
+		// the first parse broke down after its last move
+		return found()
+	}
+	return Position{}
+}
+
+// located is what the parser of locate panics with once it gets past the
+// place the first parse broke down at
+type located struct{}
+
+// nopRenderer renders nothing, only calling back into the parser for the
+// contents of blocks
+type nopRenderer struct{}
+
+func (nopRenderer) BlockCode(out *bytes.Buffer, text []byte, lang string)            {}
+func (nopRenderer) BlockQuote(out *bytes.Buffer, text []byte)                        {}
+func (nopRenderer) BlockHtml(out *bytes.Buffer, text []byte)                         {}
+func (nopRenderer) Header(out *bytes.Buffer, text func() bool, level int, id string) { text() }
+func (nopRenderer) TitleBlock(out *bytes.Buffer, text []byte)                        {}
+func (nopRenderer) HRule(out *bytes.Buffer)                                          {}
+func (nopRenderer) List(out *bytes.Buffer, text func() bool, flags, start int)       { text() }
+func (nopRenderer) ListItem(out *bytes.Buffer, text []byte, flags int)               {}
+func (nopRenderer) Paragraph(out *bytes.Buffer, text func() bool)                    { text() }
+func (nopRenderer) Table(out *bytes.Buffer, header, body []byte, columnData []int)   {}
+func (nopRenderer) TableRow(out *bytes.Buffer, text []byte)                          {}
+func (nopRenderer) TableHeaderCell(out *bytes.Buffer, text []byte, flags int)        {}
+func (nopRenderer) TableCell(out *bytes.Buffer, text []byte, flags int)              {}
+func (nopRenderer) Footnotes(out *bytes.Buffer, text func() bool)                    { text() }
+func (nopRenderer) FootnoteItem(out *bytes.Buffer, name, text []byte, flags int)     {}
+func (nopRenderer) AutoLink(out *bytes.Buffer, link []byte, kind int)                {}
+func (nopRenderer) Emphasis(out *bytes.Buffer, text []byte)                          {}
+func (nopRenderer) DoubleEmphasis(out *bytes.Buffer, text []byte)                    {}
+func (nopRenderer) TripleEmphasis(out *bytes.Buffer, text []byte)                    {}
+func (nopRenderer) StrikeThrough(out *bytes.Buffer, text []byte)                     {}
+func (nopRenderer) CodeSpan(out *bytes.Buffer, text []byte)                          {}
+func (nopRenderer) LineBreak(out *bytes.Buffer)                                      {}
+func (nopRenderer) Link(out *bytes.Buffer, link, title, content []byte)              {}
+func (nopRenderer) Image(out *bytes.Buffer, link, title, alt []byte)                 {}
+func (nopRenderer) RawHtmlTag(out *bytes.Buffer, tag []byte)                         {}
+func (nopRenderer) FootnoteRef(out *bytes.Buffer, ref []byte, id int)                {}
+func (nopRenderer) Entity(out *bytes.Buffer, entity []byte)                          {}
+func (nopRenderer) NormalText(out *bytes.Buffer, text []byte)                        {}
+func (nopRenderer) DocumentHeader(out *bytes.Buffer)                                 {}
+func (nopRenderer) DocumentFooter(out *bytes.Buffer)                                 {}
+func (nopRenderer) GetFlags() int                                                    { return 0 }
+
 // Reference represents the details of a link
 type Reference struct {
 	// Link is usually the URL the reference points to.
@@ -120,15 +373,15 @@ type Reference struct {
 	// Title is the alternate text describing the link in more details
 	Title string
 	// Text is the optional text to override the ref with if the syntax used was
-	// [refid][]
-	Tetxt string
+	// [refid][] or [refid]
+	Text string
 }
 
 // References are parsed and stored in this struct
 type reference struct {
 	link     []byte
 	title    []byte
-	noteId   int // o if no ta footnote ref
+	noteId   int // 0 if not a footnote ref, -1 until it is first referenced
 	hasBlock bool
 	text     []byte
 }
@@ -145,9 +398,53 @@ type Options struct {
 	// EXTENSIONS_* flags defined in this package
 	Extensions int
 
-	// ReferenceOveerride is an optional function callback that is called every time
+	// ReferenceOverride is an optional function callback that is called every time
 	// a reference is resolved.
+	//
+	// In Markdown, the link reference syntax can be made to resolve a link to
+	// a reference instead of an inline URL, in one of the following ways:
+	//
+	//  * [link text][refid]
+	//  * [refid][]
+	//  * [refid]
+	//
+	// Usually, the refid is defined at the bottom of the Markdown document. If
+	// this override function is provided, the refid is passed to it first,
+	// before consulting the defined refids. If the override function indicates
+	// an override did not occur, the defined refids will be used to fill in
+	// the link details; an overridden nil Reference leaves the link unresolved.
 	ReferenceOverride ReferenceOverrideFunc
+
+	// MaxNesting is how deeply blocks and inline elements may be nested
+	// in each other. Zero means the default of 16.
+	MaxNesting int
+
+	// MaxInputSize is the largest input, in bytes, that is rendered.
+	// Zero means no limit.
+	MaxInputSize int
+
+	// MaxOutputSize is the largest output, in bytes, that the document is
+	// rendered to, the list of footnotes, the table of contents and the
+	// footer included. A block that would go over it is left out, along
+	// with the rest of the document, and so is a list of footnotes. A table
+	// of contents or footer that would go over it is left out on its own.
+	// Zero means no limit.
+	MaxOutputSize int
+
+	// MaxInlineCalls is how many times, over the whole document, inline
+	// markup such as emphasis or a link may be looked for. Zero means no
+	// limit.
+	MaxInlineCalls int
+
+	// TruncationMarker is written, as normal text, in place of what is left
+	// out for going over one of the limits above. Without it MarkdownErr,
+	// MarkdownContext and Render fail with one of the ErrTooDeep,
+	// ErrInputTooLarge, ErrOutputTooLarge and ErrTooManyInlineCalls errors,
+	// while MarkdownOptions, which has no way to report them, quietly
+	// leaves the content out. Even with the default options, that happens
+	// to elements nested more than 16 deep, so callers that need to know
+	// should set a marker or call MarkdownErr.
+	TruncationMarker string
 }
 
 // MarkdownBasic is a convenience function for simple renderring
@@ -167,12 +464,95 @@ func Markdown(input []byte, renderer Renderer, extensions int) []byte {
 }
 
 // MarkdownOptions is just like Markdown but takes additional options through the Options struct
+//
+// Content going over the limits of opts, including the default MaxNesting,
+// is silently left out unless opts has a TruncationMarker to show where.
+// Use MarkdownErr to have it reported as an error instead.
 func MarkdownOptions(input []byte, renderer Renderer, opts Options) []byte {
 	// If renderer is nil, we can not render
 	if renderer == nil {
 		return nil
 	}
 
+	p := newParser(input, renderer, opts)
+	return p.render(input)
+}
+
+// MarkdownErr is just like MarkdownOptions, but rather than panicking when
+// the parser breaks down on some input, it returns an *Error telling where.
+// To find out, the input is parsed once more, up to that point, without
+// rendering it, so the renderer sees each callback only once.
+func MarkdownErr(input []byte, renderer Renderer, opts Options) (output []byte, err error) {
+	// If renderer is nil, we can not render
+	if renderer == nil {
+		return nil, nil
+	}
+
+	p := newParser(input, renderer, opts)
+	p.strict = true
+	defer p.catch(&err, input, opts)
+
+	return p.render(input), nil
+}
+
+// MarkdownContext is just like MarkdownErr, but gives up soon after ctx is
+// done, returning ctx.Err(), so that a deadline bounds the time spent on a
+// document.
+func MarkdownContext(ctx context.Context, input []byte, renderer Renderer, opts Options) (output []byte, err error) {
+	// If renderer is nil, we can not render
+	if renderer == nil {
+		return nil, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p := newParser(input, renderer, opts)
+	p.strict = true
+	p.ctx = ctx
+	defer p.catch(&err, input, opts)
+
+	return p.render(input), nil
+}
+
+// Render is just like MarkdownOptions, but reads the input from a reader and
+// writes the output to w as it goes, one top-level block at a time, instead
+// of returning it whole. The input is still read in full before rendering
+// starts, since a link may use a reference defined further down.
+//
+// The output is only held back until the end when the renderer is a
+// WholeDocumentRenderer that needs the whole document.
+//
+// Render returns the first error met reading the input or writing the
+// output. Once writing fails, rendering stops. Like MarkdownErr, it returns
+// an *Error if the parser breaks down.
+func Render(w io.Writer, input io.Reader, renderer Renderer, opts Options) (err error) {
+	// If renderer is nil, we can not render
+	if renderer == nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return err
+	}
+
+	p := newParser(data, renderer, opts)
+	p.strict = true
+	defer p.catch(&err, data, opts)
+	if r, ok := renderer.(WholeDocumentRenderer); !ok || !r.NeedsWholeDocument() {
+		p.w = w
+	}
+	output := p.render(data)
+
+	if p.err == nil {
+		_, p.err = w.Write(output)
+	}
+	return p.err
+}
+
+// newParser sets up a parser for input with the given renderer and options
+func newParser(input []byte, renderer Renderer, opts Options) *parser {
 	extensions := opts.Extensions
 
 	// fill in the render structure
@@ -182,8 +562,20 @@ func MarkdownOptions(input []byte, renderer Renderer, opts Options) []byte {
 	p.refOverride = opts.ReferenceOverride
 	p.refs = make(map[string]*reference)
 	p.maxNesting = 16
+	if opts.MaxNesting > 0 {
+		p.maxNesting = opts.MaxNesting
+	}
+	p.maxInputSize = opts.MaxInputSize
+	p.maxOutputSize = opts.MaxOutputSize
+	p.maxInlineCalls = opts.MaxInlineCalls
+	p.marker = opts.TruncationMarker
 	p.insideLink = false
 
+	if pr, ok := renderer.(PositionRenderer); ok {
+		p.pr = pr
+		p.trackSources(input)
+	}
+
 	// register inline parsers
 	p.inlineCallback['*'] = emphasis
 	p.inlineCallback['_'] = emphasis
@@ -192,23 +584,37 @@ func MarkdownOptions(input []byte, renderer Renderer, opts Options) []byte {
 	}
 	p.inlineCallback['`'] = codeSpan
 	p.inlineCallback['\n'] = lineBreak
-	//	p.inlineCallback['['] = link
-	//	p.inlineCallback['<'] = leftAngle
+	p.inlineCallback['['] = link
+	p.inlineCallback['<'] = leftAngle
 	p.inlineCallback['\\'] = escape
-	//	p.inlineCallback['&'] = entity
+	p.inlineCallback['&'] = entity
 
-	//	if extensions&EXTENSION_AUTOLINK != 0 {
-	//		p.inlineCallback[':'] = autoLink
-	//	}
+	if extensions&EXTENSION_AUTOLINK != 0 {
+		p.inlineCallback[':'] = autoLink
+		p.inlineCallback['@'] = emailAutoLink
+	}
+
+	if extensions&EXTENSION_FOOTNOTES != 0 {
+		p.notes = make([]*reference, 0)
+	}
 
-	//	if extensions&EXTENSION_FOOTNOTES != 0 {
-	p.notes = make([]*reference, 0)
-	//	}
+	return p
+}
 
-	first := firstRender(p, input)
-	second := secondRender(p, first)
+// render runs both passes of the parser over input, within MaxInputSize
+func (p *parser) render(input []byte) []byte {
+	if p.maxInputSize > 0 && len(input) > p.maxInputSize {
+		// cut between characters
+		cut := p.maxInputSize
+		for cut > 0 && !utf8.RuneStart(input[cut]) {
+			cut--
+		}
+		p.fail(ErrInputTooLarge, input[cut:])
+		input, p.overflow = input[:cut], input[cut:]
+	}
 
-	return second
+	p.first = firstRender(p, input)
+	return secondRender(p, p.first)
 }
 
 // firstRender only does the following:
@@ -218,52 +624,60 @@ func MarkdownOptions(input []byte, renderer Renderer, opts Options) []byte {
 // - copy everything else
 func firstRender(p *parser, input []byte) []byte {
 	var out bytes.Buffer
-	tabSize := TAB_SIZE_DEFAULT
-	if p.flags&EXTENSION_TAB_SIZE_EIGHT != 0 {
-		tabSize = TAB_SIZE_EIGHT
-	}
+	var m sourceMap
+	tabSize := p.tabSize()
 
 	begin, end := 0, 0
 
 	lastFencedCodeBlockEnd := 0
 
 	for begin < len(input) { // iterate over lines
-		//		if end = isReference(p, input[begin:], tabSize); end > 0 {
-		//			begin += end
-		//		} else { // skip to the next line
-		//			end = begin
+		p.checkContext()
+
+		if p.flags&EXTENSION_FENCED_CODE != 0 {
+			// track fenced code block boundaries to suppress tab expansion
+			// and reference extraction inside them
+			if begin >= lastFencedCodeBlockEnd {
+				if i := p.fencedCode(&out, input[begin:], false); i > 0 {
+					lastFencedCodeBlockEnd = begin + i
+				}
+			}
+		}
+
+		if begin >= lastFencedCodeBlockEnd {
+			if end = isReference(p, input[begin:], tabSize); end > 0 {
+				begin += end
+				continue
+			}
+		}
+
+		// skip to the next line
+		end = begin
 		for end < len(input) && input[end] != '\n' && input[end] != '\r' {
 			end++
 		}
 
-		//		if p.flags&EXTENSION_FENCED_CODE != 0 {
-		//			// track fenced code block boundaries to suppress tab expansion inside them
-		//			if begin >= lastFencedCodeBlockEnd {
-		//				if i := p.fencedCode(&out, input[begin:], false); i > 0 {
-		//					lastFencedCodeBlockEnd = begin + i
-		//				}
-		//			}
-		//		}
-
 		// add the line body if present
 		if end > begin {
 			if end < lastFencedCodeBlockEnd { // do not expand tabs while inside fenced code blocks.
+				p.copied(&m, out.Len(), input[begin:end])
 				out.Write(input[begin:end])
 			} else {
+				p.expanded(&m, out.Len(), input[begin:end], tabSize)
 				expandTabs(&out, input[begin:end], tabSize)
 			}
 		}
-		out.WriteByte('\n')
-
+		eol := end
 		if end < len(input) && input[end] == '\r' {
 			end++
 		}
 		if end < len(input) && input[end] == '\n' {
 			end++
 		}
+		p.replaced(&m, out.Len(), input[eol:end])
+		out.WriteByte('\n')
 
 		begin = end
-		//}
 	}
 
 	// empty input>
@@ -271,19 +685,458 @@ func firstRender(p *parser, input []byte) []byte {
 		out.WriteByte('\n')
 	}
 
+	p.addSource(&m, out.Bytes())
 	return out.Bytes()
 }
 
+// Check whether or not data starts with a reference link.
+// If so, it is parsed and stored in the list of references.
+// Returns the number of bytes to skip to move past it,
+// or zero if the first line is not a reference.
+//
+//	[id]: http://example.com/  "Optional Title"
+func isReference(p *parser, data []byte, tabSize int) int {
+	// up to 3 optional leading spaces
+	if len(data) < 4 {
+		return 0
+	}
+	i := 0
+	for i < 3 && data[i] == ' ' {
+		i++
+	}
+
+	noteId := 0
+
+	// id part: anything but a newline between brackets
+	if data[i] != '[' {
+		return 0
+	}
+	i++
+	idOffset := i
+	if p.flags&EXTENSION_FOOTNOTES != 0 && i < len(data) && data[i] == '^' {
+		// footnotes are numbered later, in order of first use
+		noteId = -1
+		i++
+	}
+	for i < len(data) && data[i] != '\n' && data[i] != '\r' && data[i] != ']' {
+		i++
+	}
+	if i >= len(data) || data[i] != ']' || i == idOffset || (noteId != 0 && i == idOffset+1) {
+		return 0
+	}
+	idEnd := i
+
+	// spacer: colon (space | tab)* newline? (space | tab)*
+	i++
+	if i >= len(data) || data[i] != ':' {
+		return 0
+	}
+	i++
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+	if i < len(data) && (data[i] == '\n' || data[i] == '\r') {
+		i++
+		if i < len(data) && data[i] == '\n' && data[i-1] == '\r' {
+			i++
+		}
+	}
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+	if i >= len(data) {
+		return 0
+	}
+
+	// footnote ids keep their '^', so they never clash with link ids
+	id := refId(data[idOffset:idEnd])
+
+	if noteId != 0 {
+		contents, blockEnd, hasBlock := scanFootnote(p, data, i, tabSize)
+
+		// reusing the link field for the id since footnotes don't have links,
+		// and the title field for the contents of the footnote
+		p.refs[id] = &reference{
+			link:     data[idOffset+1 : idEnd],
+			title:    contents,
+			noteId:   noteId,
+			hasBlock: hasBlock,
+		}
+		return blockEnd
+	}
+
+	linkOffset, linkEnd, titleOffset, titleEnd, lineEnd := scanLinkRef(p, data, i)
+	if lineEnd == 0 || linkEnd == linkOffset {
+		return 0
+	}
+
+	// a valid ref has been found
+	p.refs[id] = &reference{
+		link:  data[linkOffset:linkEnd],
+		title: data[titleOffset:titleEnd],
+	}
+
+	return lineEnd
+}
+
+// scanFootnote finds the whole text of a footnote definition starting at
+// data[i]: its first line, and every following line indented by one tab
+// stop, blank lines included. contents is that text with tabs expanded and
+// the indentation removed, and blockEnd is the end of the definition in data.
+// hasBlock tells whether the footnote spans more than one line.
+func scanFootnote(p *parser, data []byte, i, tabSize int) (contents []byte, blockEnd int, hasBlock bool) {
+	var raw bytes.Buffer
+	var m sourceMap
+
+	// skip leading whitespace on first line
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+
+	// put the first line into the working buffer
+	blockEnd = nextLine(data, i)
+	p.writeLine(&raw, &m, data[i:blockEnd], tabSize)
+
+	// process the following lines
+	blankLines := 0
+	for end := blockEnd; end < len(data); {
+		p.checkContext()
+		line := data[end:nextLine(data, end)]
+		end += len(line)
+
+		// if it is an empty line, guess that it is part of this footnote
+		if len(bytes.TrimLeft(line, " \t\r\n")) == 0 {
+			blankLines++
+			continue
+		}
+
+		// anything not indented ends the footnote
+		n := 0
+		if line[0] == '\t' {
+			n = 1
+		} else if skipChar(line, 0, ' ') >= tabSize {
+			n = tabSize
+		} else {
+			break
+		}
+
+		// keep the blank lines seen before this one
+		for ; blankLines > 0; blankLines-- {
+			raw.WriteByte('\n')
+		}
+		p.writeLine(&raw, &m, line[n:], tabSize)
+		hasBlock = true
+		blockEnd = end
+	}
+
+	p.addSource(&m, raw.Bytes())
+	return raw.Bytes(), blockEnd, hasBlock
+}
+
+// nextLine returns the start of the line following data[i], any newline
+// style included
+func nextLine(data []byte, i int) int {
+	for i < len(data) && data[i] != '\n' && data[i] != '\r' {
+		i++
+	}
+	if i < len(data) && data[i] == '\r' {
+		i++
+	}
+	if i < len(data) && data[i] == '\n' {
+		i++
+	}
+	return i
+}
+
+// writeLine copies a line to out with tabs expanded and a normalized newline
+func (p *parser) writeLine(out *bytes.Buffer, m *sourceMap, line []byte, tabSize int) {
+	body := bytes.TrimRight(line, "\r\n")
+	p.expanded(m, out.Len(), body, tabSize)
+	expandTabs(out, body, tabSize)
+	p.replaced(m, out.Len(), line[len(body):])
+	out.WriteByte('\n')
+}
+
+func scanLinkRef(p *parser, data []byte, i int) (linkOffset, linkEnd, titleOffset, titleEnd, lineEnd int) {
+	// link: whitespace-free sequence, optionally between angle brackets
+	if data[i] == '<' {
+		i++
+	}
+	linkOffset = i
+	for i < len(data) && data[i] != ' ' && data[i] != '\t' && data[i] != '\n' && data[i] != '\r' {
+		i++
+	}
+	linkEnd = i
+	if linkEnd > linkOffset && data[linkOffset-1] == '<' && data[linkEnd-1] == '>' {
+		linkEnd--
+	}
+
+	// optional spacer: (space | tab)* (newline | '\'' | '"' | '(' )
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+	if i < len(data) && data[i] != '\n' && data[i] != '\r' && data[i] != '\'' && data[i] != '"' && data[i] != '(' {
+		return
+	}
+
+	// compute end-of-line
+	if i >= len(data) || data[i] == '\r' || data[i] == '\n' {
+		lineEnd = i
+	}
+	if i+1 < len(data) && data[i] == '\r' && data[i+1] == '\n' {
+		lineEnd++
+	}
+
+	// optional (space|tab)* spacer after a newline
+	if lineEnd > 0 {
+		i = lineEnd + 1
+		for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+			i++
+		}
+	}
+
+	// optional title: any non-newline sequence enclosed in '"() alone on its line
+	if i+1 < len(data) && (data[i] == '\'' || data[i] == '"' || data[i] == '(') {
+		i++
+		titleOffset = i
+
+		// look for EOL
+		for i < len(data) && data[i] != '\n' && data[i] != '\r' {
+			i++
+		}
+		if i+1 < len(data) && data[i] == '\n' && data[i+1] == '\r' {
+			titleEnd = i + 1
+		} else {
+			titleEnd = i
+		}
+
+		// step back
+		i--
+		for i > titleOffset && (data[i] == ' ' || data[i] == '\t') {
+			i--
+		}
+		if i > titleOffset && (data[i] == '\'' || data[i] == '"' || data[i] == ')') {
+			lineEnd = titleEnd
+			titleEnd = i
+		}
+	}
+
+	return
+}
+
+// refId normalizes a reference id: matches are case-insensitive, and any
+// run of whitespace counts as a single space
+func refId(id []byte) string {
+	return strings.ToLower(collapseSpace(id))
+}
+
+// collapseSpace trims a string and replaces each run of whitespace in it by
+// a single space
+func collapseSpace(text []byte) string {
+	return strings.Join(strings.Fields(string(text)), " ")
+}
+
+// getRef looks up a reference, giving the override callback the first say
+func (p *parser) getRef(refid []byte) (ref *reference, found bool) {
+	if p.refOverride != nil {
+		r, overridden := p.refOverride(collapseSpace(refid))
+		if overridden {
+			if r == nil {
+				return nil, false
+			}
+			return &reference{
+				link:  []byte(r.Link),
+				title: []byte(r.Title),
+				text:  []byte(r.Text),
+			}, true
+		}
+	}
+	ref, found = p.refs[refId(refid)]
+	return ref, found
+}
+
+// tabSize returns the width of a tab stop, which is also the indentation
+// of a code block
+func (p *parser) tabSize() int {
+	if p.flags&EXTENSION_TAB_SIZE_EIGHT != 0 {
+		return TAB_SIZE_EIGHT
+	}
+	return TAB_SIZE_DEFAULT
+}
+
 // secondRender: actual renderring
 func secondRender(p *parser, input []byte) []byte {
 	var out bytes.Buffer
 
+	// a title block is parsed first, so the document header can use it
+	var title bytes.Buffer
+	if p.flags&EXTENSION_TITLEBLOCK != 0 {
+		input = input[p.titleBlock(&title, input):]
+	}
+
 	p.r.DocumentHeader(&out)
-	p.block(&out, input)
+	out.Write(title.Bytes())
+	p.top, p.mark, p.markInput = &out, out.Len(), input
+	if len(input) > 0 {
+		p.block(&out, input)
+	}
+	if p.outgrown {
+		// leave out the block that went over MaxOutputSize
+		out.Truncate(p.mark)
+		p.truncate(&out, ErrOutputTooLarge, p.markInput)
+	}
+	if p.overflow != nil && !p.stopped {
+		p.truncate(&out, ErrInputTooLarge, p.overflow)
+	}
+
+	if p.flags&EXTENSION_FOOTNOTES != 0 && len(p.notes) > 0 && !p.stopped {
+		// the list of footnotes has no place in the input
+		p.mark, p.markInput = out.Len(), nil
+		p.span(nil)
+		p.r.Footnotes(&out, func() bool {
+			flags := LIST_ITEM_BEGINNING_OF_LIST
+			// footnotes may refer to further footnotes, growing the list
+			for i := 0; i < len(p.notes); i++ {
+				ref := p.notes[i]
+				var buf bytes.Buffer
+				if ref.hasBlock {
+					flags |= LIST_ITEM_CONTAINS_BLOCK
+					p.block(&buf, ref.title)
+				} else {
+					p.inline(&buf, bytes.TrimRight(ref.title, "\n"))
+				}
+				p.blockSpan(ref.title)
+				p.r.FootnoteItem(&out, ref.link, bytes.TrimRight(buf.Bytes(), "\n"), flags)
+				flags &^= LIST_ITEM_BEGINNING_OF_LIST | LIST_ITEM_CONTAINS_BLOCK
+			}
+			return true
+		})
+		if p.outgrown || p.maxOutputSize > 0 && p.outputSize(&out) > p.maxOutputSize {
+			out.Truncate(p.mark)
+			p.stop(&out, ErrOutputTooLarge, nil)
+		}
+	}
+
+	// the footer, with any table of contents it puts in, counts towards
+	// MaxOutputSize too, and is left out if it goes over
+	var body []byte
+	if p.maxOutputSize > 0 {
+		body = append(body, out.Bytes()...)
+	}
 	p.r.DocumentFooter(&out)
+	if p.maxOutputSize > 0 && p.outputSize(&out) > p.maxOutputSize {
+		out.Reset()
+		out.Write(body)
+		if !p.stopped {
+			p.stop(&out, ErrOutputTooLarge, nil)
+		}
+	}
 
 	if p.nesting != 0 {
-		panic("Nesting level did not end at zero")
+		panic(ErrNesting)
 	}
 	return out.Bytes()
 }
+
+// endTopBlock is called as each top-level block is done, with next the
+// input that follows. It leaves the block out if it goes over MaxOutputSize,
+// and otherwise writes it to the stream, if any, stopping once that fails.
+// It reports whether rendering goes on.
+func (p *parser) endTopBlock(out *bytes.Buffer, next []byte) bool {
+	if p.maxOutputSize > 0 && p.outputSize(out) > p.maxOutputSize {
+		out.Truncate(p.mark)
+		p.stop(out, ErrOutputTooLarge, p.markInput)
+		return false
+	}
+	if p.w != nil {
+		p.flush(out)
+		if p.err != nil {
+			p.stopped = true
+			return false
+		}
+	}
+	p.mark, p.markInput = out.Len(), next
+	return true
+}
+
+// flush writes out what has been rendered to the stream so far. The last
+// byte is held back, as renderers look at it to space out the next block.
+func (p *parser) flush(out *bytes.Buffer) {
+	if out.Len() <= 1 {
+		return
+	}
+	if p.err == nil {
+		_, p.err = p.w.Write(out.Bytes()[:out.Len()-1])
+	}
+	p.written += out.Len() - 1
+	last := out.Bytes()[out.Len()-1]
+	out.Reset()
+	out.WriteByte(last)
+}
+
+// outputSize is the size of the output so far, counting out, the buffer
+// being rendered to, along with the top-level blocks. The buffers of the
+// elements out is nested in are left out, but they are all checked in turn.
+func (p *parser) outputSize(out *bytes.Buffer) int {
+	size := p.written + p.top.Len()
+	if out != p.top {
+		size += out.Len()
+	}
+	return size
+}
+
+// checkOutput stops rendering once the output goes over MaxOutputSize. It is
+// called on every step of the block and inline loops, so that no block can
+// grow far beyond the limit before endTopBlock gets to look at it.
+func (p *parser) checkOutput(out *bytes.Buffer) {
+	if p.maxOutputSize == 0 || p.top == nil || p.stopped || p.outputSize(out) <= p.maxOutputSize {
+		return
+	}
+	p.fail(ErrOutputTooLarge, p.markInput)
+	p.stopped, p.outgrown = true, true
+}
+
+// checkContext gives up on rendering once the context of MarkdownContext is
+// done. It is called on every step of the block and inline loops, and on
+// every line the block parsers and the first pass scan, but only looks at
+// the context every contextInterval steps.
+func (p *parser) checkContext() {
+	if p.ctx == nil {
+		return
+	}
+	if p.steps++; p.steps < contextInterval {
+		return
+	}
+	p.steps = 0
+	select {
+	case <-p.ctx.Done():
+		panic(canceled{p.ctx.Err()})
+	default:
+	}
+}
+
+// fail makes the parser fail with err, for data going over one of the
+// limits of Options, unless there is a truncation marker to write in its
+// place or no way to report the error
+func (p *parser) fail(err error, data []byte) {
+	if p.marker == "" && p.strict {
+		p.at = data
+		panic(err)
+	}
+}
+
+// truncate leaves out data, which goes over one of the limits of Options,
+// writing the truncation marker in its place
+func (p *parser) truncate(out *bytes.Buffer, err error, data []byte) {
+	p.fail(err, data)
+	if p.marker != "" {
+		p.span(nil)
+		p.r.NormalText(out, []byte(p.marker))
+	}
+}
+
+// stop is truncate for data along with all that follows it
+func (p *parser) stop(out *bytes.Buffer, err error, data []byte) {
+	p.truncate(out, err, data)
+	p.stopped = true
+}
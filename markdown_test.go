@@ -0,0 +1,347 @@
+//
+// markdown_test.go
+// Copyright (C) 2016 wanglong <wanglong@laoqinren.net>
+//
+// Distributed under terms of the MIT license.
+//
+
+package markdown
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkWriter keeps each write it gets apart
+type chunkWriter struct {
+	chunks []string
+	err    error
+}
+
+func (w *chunkWriter) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.chunks = append(w.chunks, string(data))
+	return len(data), nil
+}
+
+func TestRender(t *testing.T) {
+	var tests = []string{
+		"# Header\n\nSome *emphasis*.\n\n* one\n* two\n\n> quote\n\n---\n",
+		"para\n\n[ref][1]\n\n[1]: /defined/after/use\n",
+		"text[^note]\n\nmore\n\n[^note]: the note\n",
+		"% Title\n\nbody\n",
+		"",
+	}
+
+	extensions := EXTENSION_FOOTNOTES | EXTENSION_TITLEBLOCK
+	for _, flags := range []int{HTML_USE_XHTML, HTML_COMPLETE_PAGE, HTML_TOC} {
+		for _, input := range tests {
+			expected := MarkdownOptions([]byte(input), HtmlRenderer(flags, "", ""), Options{Extensions: extensions})
+			var w chunkWriter
+			err := Render(&w, strings.NewReader(input), HtmlRenderer(flags, "", ""), Options{Extensions: extensions})
+			if err != nil || strings.Join(w.chunks, "") != string(expected) {
+				t.Errorf("\nInput	[%#v]\nExpected[%#v]\nActual	[%#v]\nError	[%v]",
+					input, string(expected), strings.Join(w.chunks, ""), err)
+			}
+		}
+	}
+}
+
+func TestRenderStreams(t *testing.T) {
+	assert := require.New(t)
+
+	var w chunkWriter
+	err := Render(&w, strings.NewReader("# one\n\ntwo\n\n* three\n"), HtmlRenderer(0, "", ""), Options{})
+	assert.NoError(err)
+	assert.Equal([]string{"<h1>one</h1>", "\n\n<p>two</p>", "\n\n<ul>\n<li>three</li>\n</ul>", "\n"}, w.chunks)
+
+	// the table of contents needs the whole document
+	w = chunkWriter{}
+	err = Render(&w, strings.NewReader("# one\n\n# two\n"), HtmlRenderer(HTML_TOC, "", ""), Options{})
+	assert.NoError(err)
+	assert.Len(w.chunks, 1)
+
+	// which is up to the renderer, whatever flags it has
+	w = chunkWriter{}
+	err = Render(&w, strings.NewReader("# one\n\n# two\n"), &flagsRenderer{HtmlRenderer(0, "", ""), HTML_TOC}, Options{})
+	assert.NoError(err)
+	assert.Len(w.chunks, 3)
+}
+
+// flagsRenderer is a Renderer claiming other flags than it renders with
+type flagsRenderer struct {
+	Renderer
+	flags int
+}
+
+func (r *flagsRenderer) GetFlags() int {
+	return r.flags
+}
+
+// paragraphCounter counts the paragraphs it renders
+type paragraphCounter struct {
+	Renderer
+	count int
+}
+
+func (r *paragraphCounter) Paragraph(out *bytes.Buffer, text func() bool) {
+	r.count++
+	r.Renderer.Paragraph(out, text)
+}
+
+func TestRenderErrors(t *testing.T) {
+	assert := require.New(t)
+
+	failed := errors.New("failed")
+	w := chunkWriter{err: failed}
+	assert.Equal(failed, Render(&w, strings.NewReader("one\n\ntwo\n"), HtmlRenderer(0, "", ""), Options{}))
+	assert.Empty(w.chunks)
+
+	// nothing more is parsed once writing fails
+	w = chunkWriter{err: failed}
+	counter := &paragraphCounter{Renderer: HtmlRenderer(0, "", "")}
+	assert.Equal(failed, Render(&w, strings.NewReader("one\n\ntwo\n\nthree\n"), counter, Options{}))
+	assert.Equal(1, counter.count)
+
+	w = chunkWriter{}
+	assert.Equal(failed, Render(&w, iotest.ErrReader(failed), HtmlRenderer(0, "", ""), Options{}))
+	assert.Empty(w.chunks)
+}
+
+func TestMarkdownErr(t *testing.T) {
+	assert := require.New(t)
+
+	output, err := MarkdownErr([]byte("*one*\n"), HtmlRenderer(0, "", ""), Options{})
+	assert.NoError(err)
+	assert.Equal("<p><em>one</em></p>\n", string(output))
+
+	// a renderer that breaks down when it meets emphasis
+	_, err = MarkdownErr([]byte("# one\n\ntwo\tand *three*\n"), &panicRenderer{HtmlRenderer(0, "", "")}, Options{})
+	assert.Error(err)
+	failure, ok := err.(*Error)
+	assert.True(ok)
+	assert.Equal(errPanicRenderer, failure.Err)
+	assert.Equal(Position{Offset: 15, Line: 3, Column: 9}, failure.Position)
+	assert.Equal("markdown: line 3, column 9: emphasis", err.Error())
+	assert.True(errors.Is(err, errPanicRenderer))
+
+	// finding out where takes another parse, which the renderer never sees
+	counter := &paragraphCounter{Renderer: &panicRenderer{HtmlRenderer(0, "", "")}}
+	_, err = MarkdownErr([]byte("one\n\n> * two\n>   and *three*\n"), counter, Options{})
+	assert.True(errors.Is(err, errPanicRenderer))
+	assert.Equal(Position{Offset: 21, Line: 4, Column: 9}, err.(*Error).Position)
+	assert.Equal(1, counter.count)
+
+	w := chunkWriter{}
+	err = Render(&w, strings.NewReader("one\n\n*two*\n"), &panicRenderer{HtmlRenderer(0, "", "")}, Options{})
+	assert.True(errors.Is(err, errPanicRenderer))
+	assert.Equal(Position{Offset: 5, Line: 3, Column: 1}, err.(*Error).Position)
+	assert.Equal([]string{"<p>one</p>"}, w.chunks)
+}
+
+var errPanicRenderer = errors.New("emphasis")
+
+type panicRenderer struct {
+	Renderer
+}
+
+func (r *panicRenderer) Emphasis(out *bytes.Buffer, text []byte) {
+	panic(errPanicRenderer)
+}
+
+// fuzzExtensions are the sets of extensions the fuzz targets try each
+// input with
+var fuzzExtensions = []int{0, commonExtension, EXTENSION_DEFINITION_LISTS<<1 - 1}
+
+func FuzzMarkdownErr(f *testing.F) {
+	for _, seed := range []string{
+		"# Header\n\nSome *emphasis*, **strong** and ***both***.\n",
+		"> quote\n> * list\n>   1. nested\n\n    code\n",
+		"| a | b |\n|---|---|\n| 1 | 2 |\n",
+		"```go\ncode\n```\n\nTerm\n: definition\n",
+		"[link](/url \"title\") ![image](/img) <http://x.y> a@b.c\n",
+		"text[^1]\n\n[^1]: note\n\n    more\n",
+		"% Title\n\n<div>\nhtml\n</div>\n",
+		"line  \nbreak\\\nhere\r\n\ttab\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		for _, extensions := range fuzzExtensions {
+			renderer := HtmlRenderer(commonHtmlFlags|HTML_TOC|HTML_FOOTNOTE_RETURN_LINKS, "", "")
+			// going over the default nesting limit is the one error
+			// the input can cause
+			_, err := MarkdownErr(input, renderer, Options{Extensions: extensions})
+			if err != nil && !errors.Is(err, ErrTooDeep) {
+				t.Errorf("extensions %#x: %v", extensions, err)
+			}
+		}
+	})
+}
+
+func TestLimits(t *testing.T) {
+	assert := require.New(t)
+
+	var tests = []struct {
+		input    string
+		opts     Options
+		expected string
+		err      error
+		position Position
+	}{
+		{"> > > a\n\nb\n", Options{MaxNesting: 2},
+			"<blockquote>\n<blockquote>\n[cut]</blockquote>\n</blockquote>\n\n<p>b</p>\n",
+			ErrTooDeep, Position{4, 1, 5}},
+		{"one\n\ntwo\n", Options{MaxInputSize: 5},
+			"<p>one</p>\n[cut]",
+			ErrInputTooLarge, Position{5, 3, 1}},
+		{"one\n\ntwo\n\nthree\n", Options{MaxOutputSize: 20},
+			"<p>one</p>\n[cut]",
+			ErrOutputTooLarge, Position{5, 3, 1}},
+		{"*a* *b* *c*\n\nd\n", Options{MaxInlineCalls: 2},
+			"<p><em>a</em> <em>b</em> [cut]</p>\n",
+			ErrTooManyInlineCalls, Position{8, 1, 9}},
+
+		// the output is also checked while a block is rendered
+		{"*a* *b* *c* *d*\n", Options{MaxOutputSize: 20},
+			"[cut]",
+			ErrOutputTooLarge, Position{0, 1, 1}},
+		{"para\n\n* a\n* b\n* c\n", Options{MaxOutputSize: 30},
+			"<p>para</p>\n[cut]",
+			ErrOutputTooLarge, Position{6, 3, 1}},
+
+		// and the footnotes count towards it
+		{"a[^1]\n\n[^1]: the note\n", Options{Extensions: EXTENSION_FOOTNOTES, MaxOutputSize: 120},
+			"<p>a<sup class=\"footnote-ref\" id=\"fnref:1\"><a rel=\"footnote\" href=\"#fn:1\">1</a></sup></p>\n[cut]",
+			ErrOutputTooLarge, Position{}},
+	}
+
+	for _, test := range tests {
+		// the marker takes the place of what is left out
+		opts := test.opts
+		opts.TruncationMarker = "[cut]"
+		output, err := MarkdownErr([]byte(test.input), HtmlRenderer(0, "", ""), opts)
+		assert.NoError(err)
+		assert.Equal(test.expected, string(output))
+
+		// and without it, the limit is an error
+		_, err = MarkdownErr([]byte(test.input), HtmlRenderer(0, "", ""), test.opts)
+		assert.Equal(&Error{Err: test.err, Position: test.position}, err)
+
+		w := chunkWriter{}
+		err = Render(&w, strings.NewReader(test.input), HtmlRenderer(0, "", ""), test.opts)
+		assert.True(errors.Is(err, test.err))
+
+		// which MarkdownOptions has no way to report
+		output = MarkdownOptions([]byte(test.input), HtmlRenderer(0, "", ""), test.opts)
+		assert.Equal(strings.Replace(test.expected, "[cut]", "", -1), string(output))
+	}
+}
+
+func TestOutputLimitFooter(t *testing.T) {
+	assert := require.New(t)
+
+	// the table of contents and the footer are left out when they go over
+	var tests = []struct {
+		input    string
+		flags    int
+		expected string
+	}{
+		{"# a\n\nb\n", HTML_TOC,
+			"<h1 id=\"toc_0\">a</h1>\n\n<p>b</p>\n[cut]"},
+		{"a\n", HTML_COMPLETE_PAGE,
+			"<!DOCTYPE html>\n<html>\n<head>\n  <title></title>\n" +
+				"  <meta name=\"GENERATOR\" content=\"Markdown Processor v0.1\">\n  <meta charset=\"utf-8\">\n" +
+				"</head>\n<body>\n\n<p>a</p>\n[cut]"},
+	}
+
+	for _, test := range tests {
+		opts := Options{MaxOutputSize: len(test.expected), TruncationMarker: "[cut]"}
+		output, err := MarkdownErr([]byte(test.input), HtmlRenderer(test.flags, "", ""), opts)
+		assert.NoError(err)
+		assert.Equal(test.expected, string(output))
+
+		opts.TruncationMarker = ""
+		_, err = MarkdownErr([]byte(test.input), HtmlRenderer(test.flags, "", ""), opts)
+		assert.Equal(&Error{Err: ErrOutputTooLarge}, err)
+	}
+}
+
+func TestOutputLimitStopsEarly(t *testing.T) {
+	assert := require.New(t)
+
+	// a block going over the limit is not rendered to the end
+	renderer := &emphasisCounter{Renderer: HtmlRenderer(0, "", "")}
+	input := strings.Repeat("*a* ", 10000) + "\n"
+	output := MarkdownOptions([]byte(input), renderer, Options{MaxOutputSize: 100})
+	assert.Empty(output)
+	assert.True(renderer.count < 20)
+}
+
+// emphasisCounter counts the emphasis it renders
+type emphasisCounter struct {
+	Renderer
+	count int
+}
+
+func (r *emphasisCounter) Emphasis(out *bytes.Buffer, text []byte) {
+	r.count++
+	r.Renderer.Emphasis(out, text)
+}
+
+func TestMarkdownContext(t *testing.T) {
+	assert := require.New(t)
+
+	output, err := MarkdownContext(context.Background(), []byte("*one*\n"), HtmlRenderer(0, "", ""), Options{})
+	assert.NoError(err)
+	assert.Equal("<p><em>one</em></p>\n", string(output))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	output, err = MarkdownContext(ctx, []byte("*one*\n"), HtmlRenderer(0, "", ""), Options{})
+	assert.Equal(context.Canceled, err)
+	assert.Nil(output)
+
+	// a context done while rendering stops it within contextInterval steps
+	ctx, cancel = context.WithCancel(context.Background())
+	renderer := &cancelRenderer{HtmlRenderer(0, "", ""), cancel, 0}
+	input := strings.Repeat("*a* b\n\n", 2*contextInterval)
+	_, err = MarkdownContext(ctx, []byte(input), renderer, Options{})
+	assert.Equal(context.Canceled, err)
+	assert.True(renderer.emphasis <= contextInterval)
+}
+
+func TestMarkdownContextInsideBlock(t *testing.T) {
+	assert := require.New(t)
+
+	// the whole input is one deeply nested list, which is given up on
+	// part way through rather than at its end
+	lines := 4 * contextInterval
+	input := strings.Repeat(strings.Repeat("- ", 5)+"*a* [b](c)\n", lines)
+	ctx, cancel := context.WithCancel(context.Background())
+	renderer := &cancelRenderer{HtmlRenderer(0, "", ""), cancel, 0}
+	output, err := MarkdownContext(ctx, []byte(input), renderer, Options{})
+	assert.Equal(context.Canceled, err)
+	assert.Nil(output)
+	assert.True(renderer.emphasis > 0 && renderer.emphasis <= contextInterval, "%d of %d items", renderer.emphasis, lines)
+}
+
+// cancelRenderer cancels its context when it meets emphasis
+type cancelRenderer struct {
+	Renderer
+	cancel   context.CancelFunc
+	emphasis int
+}
+
+func (r *cancelRenderer) Emphasis(out *bytes.Buffer, text []byte) {
+	r.cancel()
+	r.emphasis++
+	r.Renderer.Emphasis(out, text)
+}
@@ -0,0 +1,581 @@
+//
+// node.go
+// Copyright (C) 2016 wanglong <wanglong@laoqinren.net>
+//
+// Distributed under terms of the MIT license.
+//
+
+//
+//
+// Document tree
+//
+//
+
+package markdown
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// NodeType identifies the kind of a Node. There is one for each Renderer
+// callback, plus Document for the root and Text for normal text, with one
+// Text node for each NormalText call the parser makes.
+type NodeType int
+
+const (
+	Document NodeType = iota
+	TitleBlock
+	BlockCode
+	BlockQuote
+	BlockHtml
+	Header
+	HRule
+	List
+	ListItem
+	Paragraph
+	Table
+	TableRow
+	TableHeaderCell
+	TableCell
+	Footnotes
+	FootnoteItem
+	AutoLink
+	CodeSpan
+	Emphasis
+	DoubleEmphasis
+	TripleEmphasis
+	StrikeThrough
+	LineBreak
+	Link
+	Image
+	RawHtmlTag
+	FootnoteRef
+	Entity
+	Text
+)
+
+var nodeTypeNames = []string{
+	Document:        "Document",
+	TitleBlock:      "TitleBlock",
+	BlockCode:       "BlockCode",
+	BlockQuote:      "BlockQuote",
+	BlockHtml:       "BlockHtml",
+	Header:          "Header",
+	HRule:           "HRule",
+	List:            "List",
+	ListItem:        "ListItem",
+	Paragraph:       "Paragraph",
+	Table:           "Table",
+	TableRow:        "TableRow",
+	TableHeaderCell: "TableHeaderCell",
+	TableCell:       "TableCell",
+	Footnotes:       "Footnotes",
+	FootnoteItem:    "FootnoteItem",
+	AutoLink:        "AutoLink",
+	CodeSpan:        "CodeSpan",
+	Emphasis:        "Emphasis",
+	DoubleEmphasis:  "DoubleEmphasis",
+	TripleEmphasis:  "TripleEmphasis",
+	StrikeThrough:   "StrikeThrough",
+	LineBreak:       "LineBreak",
+	Link:            "Link",
+	Image:           "Image",
+	RawHtmlTag:      "RawHtmlTag",
+	FootnoteRef:     "FootnoteRef",
+	Entity:          "Entity",
+	Text:            "Text",
+}
+
+func (t NodeType) String() string {
+	if t < 0 || int(t) >= len(nodeTypeNames) {
+		return "NodeType(" + strconv.Itoa(int(t)) + ")"
+	}
+	return nodeTypeNames[t]
+}
+
+// Node is a single element of the document tree built by Parse. Which of
+// the attribute fields are set depends on the Type of the node.
+type Node struct {
+	Type     NodeType
+	Parent   *Node
+	Children []*Node
+
+	// Span is where the node comes from in the input. It is zero for nodes
+	// that have no place in it, such as the list of footnotes.
+	Span Span
+
+	// Literal holds the text of Text, CodeSpan, BlockCode, BlockHtml,
+	// RawHtmlTag, Entity and TitleBlock nodes, and the alt text of an Image
+	Literal []byte
+
+	Level int    // Header level
+	ID    string // Header id
+	Info  string // BlockCode info string
+
+	// Flags holds the LIST_* flags of List, ListItem and FootnoteItem
+	// nodes, the TABLE_ALIGNMENT_* flags of table cells and the LINK_TYPE_*
+	// of an AutoLink
+	Flags   int
+	Start   int   // number of the first item of an ordered List
+	Columns []int // TABLE_ALIGNMENT_* flags of each column of a Table
+
+	Destination []byte // Link, Image and AutoLink target
+	Title       []byte // Link and Image title
+	Name        []byte // FootnoteItem and FootnoteRef name
+	NoteID      int    // FootnoteRef number
+}
+
+// AppendChild adds child as the last child of n
+func (n *Node) AppendChild(child *Node) {
+	child.Parent = n
+	n.Children = append(n.Children, child)
+}
+
+// WalkStatus tells Walk how to go on after visiting a node
+type WalkStatus int
+
+const (
+	GoToNext     WalkStatus = iota // continue with the next node
+	SkipChildren                   // skip the children of the node just entered
+	Terminate                      // stop walking
+)
+
+// NodeVisitor is called by Walk when entering each node, and when leaving
+// each node that has children.
+type NodeVisitor func(node *Node, entering bool) WalkStatus
+
+// Walk visits n and all of its descendants in document order
+func (n *Node) Walk(visitor NodeVisitor) {
+	n.walk(visitor)
+}
+
+func (n *Node) walk(visitor NodeVisitor) WalkStatus {
+	status := visitor(n, true)
+	if status == Terminate {
+		return Terminate
+	}
+	if len(n.Children) == 0 {
+		return GoToNext
+	}
+
+	if status != SkipChildren {
+		for _, child := range n.Children {
+			if child.walk(visitor) == Terminate {
+				return Terminate
+			}
+		}
+	}
+	if visitor(n, false) == Terminate {
+		return Terminate
+	}
+	return GoToNext
+}
+
+// Parse parses markdown input into a tree of Nodes rooted at a Document.
+// RenderNode replays the tree, possibly after it has been changed, into a
+// Renderer.
+func Parse(input []byte, opts Options) *Node {
+	tree := &treeRenderer{lines: newLineIndex(input), joined: make(map[*Node][]*Node)}
+	out := MarkdownOptions(input, tree, opts)
+
+	doc := &Node{Type: Document}
+	doc.Span = Span{Start: tree.lines.position(0), End: tree.lines.position(len(input))}
+	tree.attach(doc, out)
+	return doc
+}
+
+// treeRenderer is the Renderer used by Parse. Rather than formatted output,
+// it writes a reference to each node it creates: a zero byte, the index of
+// the node and another zero byte. Normal text is written as is after the
+// reference to its Text node, except for zero bytes which are doubled, so
+// that the parser can still look back at it. The nodes are then picked back
+// out of the output of their parent.
+type treeRenderer struct {
+	nodes []*Node
+	lines *lineIndex
+	span  Span // span of the next node
+
+	// the Text node whose reference was written last, and where its text
+	// ends in the output and in the input
+	text     *Node
+	textOut  *bytes.Buffer
+	textEnd  int
+	textSpan Span
+
+	// Text nodes of later calls sharing the reference of a Text node
+	joined map[*Node][]*Node
+}
+
+func (tree *treeRenderer) SetSpan(span Span) {
+	tree.span = span
+}
+
+// write writes out a reference to n
+func (tree *treeRenderer) write(out *bytes.Buffer, n *Node) {
+	out.WriteByte(0)
+	out.WriteString(strconv.Itoa(len(tree.nodes)))
+	out.WriteByte(0)
+	tree.nodes = append(tree.nodes, n)
+}
+
+// add writes out a reference to n, taking its children from the output of
+// the parser in children
+func (tree *treeRenderer) add(out *bytes.Buffer, n *Node, children []byte) {
+	n.Span = tree.span
+	tree.attach(n, children)
+	tree.write(out, n)
+}
+
+// addBlock is add for the callbacks that write their children to out
+func (tree *treeRenderer) addBlock(out *bytes.Buffer, n *Node, text func() bool) {
+	n.Span = tree.span
+	marker := out.Len()
+	if !text() {
+		out.Truncate(marker)
+		return
+	}
+	children := append([]byte(nil), out.Bytes()[marker:]...)
+	out.Truncate(marker)
+	tree.attach(n, children)
+	tree.write(out, n)
+}
+
+// attach appends the nodes referred to in data to n, along with the Text
+// nodes of the text in between
+func (tree *treeRenderer) attach(n *Node, data []byte) {
+	var text *Node
+	var literal []byte
+	flush := func() {
+		if text == nil || len(literal) == 0 {
+			text, literal = nil, nil
+			return
+		}
+
+		// hand the text back out to the nodes of the calls that wrote it
+		pieces := append([]*Node{text}, tree.joined[text]...)
+		for i, piece := range pieces {
+			size := len(piece.Literal)
+			if i == len(pieces)-1 || size > len(literal) {
+				size = len(literal)
+			}
+			if size == 0 {
+				break
+			}
+
+			// the parser may have taken back the end of the text, as it
+			// does with the '!' of an image
+			span := piece.Span
+			if size < len(piece.Literal) && span.End.Offset-span.Start.Offset == len(piece.Literal) {
+				piece.Span.End = tree.lines.position(span.Start.Offset + size)
+			}
+			piece.Literal = literal[:size]
+			literal = literal[size:]
+			n.AppendChild(piece)
+		}
+		text, literal = nil, nil
+	}
+
+	for i := 0; i < len(data); {
+		if data[i] != 0 {
+			end := i + 1
+			for end < len(data) && data[end] != 0 {
+				end++
+			}
+			if text == nil {
+				text = &Node{Type: Text}
+			}
+			literal = append(literal, data[i:end]...)
+			i = end
+			continue
+		}
+
+		end := i + 1
+		for end < len(data) && data[end] != 0 {
+			end++
+		}
+		if end >= len(data) {
+			// only written by the tree renderer, so this never happens
+			break
+		}
+		if end == i+1 {
+			if text == nil {
+				text = &Node{Type: Text}
+			}
+			literal = append(literal, 0)
+		} else {
+			id, _ := strconv.Atoi(string(data[i+1 : end]))
+			flush()
+			if child := tree.nodes[id]; child.Type == Text {
+				text = child
+			} else {
+				n.AppendChild(child)
+			}
+		}
+		i = end + 1
+	}
+	flush()
+}
+
+func (tree *treeRenderer) BlockCode(out *bytes.Buffer, text []byte, lang string) {
+	tree.add(out, &Node{Type: BlockCode, Literal: copyBytes(text), Info: lang}, nil)
+}
+
+func (tree *treeRenderer) BlockQuote(out *bytes.Buffer, text []byte) {
+	tree.add(out, &Node{Type: BlockQuote}, text)
+}
+
+func (tree *treeRenderer) BlockHtml(out *bytes.Buffer, text []byte) {
+	tree.add(out, &Node{Type: BlockHtml, Literal: copyBytes(text)}, nil)
+}
+
+func (tree *treeRenderer) Header(out *bytes.Buffer, text func() bool, level int, id string) {
+	tree.addBlock(out, &Node{Type: Header, Level: level, ID: id}, text)
+}
+
+func (tree *treeRenderer) TitleBlock(out *bytes.Buffer, text []byte) {
+	tree.add(out, &Node{Type: TitleBlock, Literal: copyBytes(text)}, nil)
+}
+
+func (tree *treeRenderer) HRule(out *bytes.Buffer) {
+	tree.add(out, &Node{Type: HRule}, nil)
+}
+
+func (tree *treeRenderer) List(out *bytes.Buffer, text func() bool, flags, start int) {
+	tree.addBlock(out, &Node{Type: List, Flags: flags, Start: start}, text)
+}
+
+func (tree *treeRenderer) ListItem(out *bytes.Buffer, text []byte, flags int) {
+	tree.add(out, &Node{Type: ListItem, Flags: flags}, text)
+}
+
+func (tree *treeRenderer) Paragraph(out *bytes.Buffer, text func() bool) {
+	tree.addBlock(out, &Node{Type: Paragraph}, text)
+}
+
+func (tree *treeRenderer) Table(out *bytes.Buffer, header []byte, body []byte, columnData []int) {
+	rows := append(append([]byte(nil), header...), body...)
+	tree.add(out, &Node{Type: Table, Columns: append([]int(nil), columnData...)}, rows)
+}
+
+func (tree *treeRenderer) TableRow(out *bytes.Buffer, text []byte) {
+	tree.add(out, &Node{Type: TableRow}, text)
+}
+
+func (tree *treeRenderer) TableHeaderCell(out *bytes.Buffer, text []byte, flags int) {
+	tree.add(out, &Node{Type: TableHeaderCell, Flags: flags}, text)
+}
+
+func (tree *treeRenderer) TableCell(out *bytes.Buffer, text []byte, flags int) {
+	tree.add(out, &Node{Type: TableCell, Flags: flags}, text)
+}
+
+func (tree *treeRenderer) Footnotes(out *bytes.Buffer, text func() bool) {
+	tree.addBlock(out, &Node{Type: Footnotes}, text)
+}
+
+func (tree *treeRenderer) FootnoteItem(out *bytes.Buffer, name, text []byte, flags int) {
+	tree.add(out, &Node{Type: FootnoteItem, Name: copyBytes(name), Flags: flags}, text)
+}
+
+func (tree *treeRenderer) AutoLink(out *bytes.Buffer, link []byte, kind int) {
+	tree.add(out, &Node{Type: AutoLink, Destination: copyBytes(link), Flags: kind}, nil)
+}
+
+func (tree *treeRenderer) Emphasis(out *bytes.Buffer, text []byte) {
+	tree.add(out, &Node{Type: Emphasis}, text)
+}
+
+func (tree *treeRenderer) DoubleEmphasis(out *bytes.Buffer, text []byte) {
+	tree.add(out, &Node{Type: DoubleEmphasis}, text)
+}
+
+func (tree *treeRenderer) TripleEmphasis(out *bytes.Buffer, text []byte) {
+	tree.add(out, &Node{Type: TripleEmphasis}, text)
+}
+
+func (tree *treeRenderer) StrikeThrough(out *bytes.Buffer, text []byte) {
+	tree.add(out, &Node{Type: StrikeThrough}, text)
+}
+
+func (tree *treeRenderer) CodeSpan(out *bytes.Buffer, text []byte) {
+	tree.add(out, &Node{Type: CodeSpan, Literal: copyBytes(text)}, nil)
+}
+
+func (tree *treeRenderer) LineBreak(out *bytes.Buffer) {
+	tree.add(out, &Node{Type: LineBreak}, nil)
+}
+
+func (tree *treeRenderer) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
+	tree.add(out, &Node{Type: Link, Destination: copyBytes(link), Title: copyBytes(title)}, content)
+}
+
+func (tree *treeRenderer) Image(out *bytes.Buffer, link []byte, title []byte, alt []byte) {
+	tree.add(out, &Node{Type: Image, Destination: copyBytes(link), Title: copyBytes(title), Literal: copyBytes(alt)}, nil)
+}
+
+func (tree *treeRenderer) RawHtmlTag(out *bytes.Buffer, tag []byte) {
+	tree.add(out, &Node{Type: RawHtmlTag, Literal: copyBytes(tag)}, nil)
+}
+
+func (tree *treeRenderer) FootnoteRef(out *bytes.Buffer, ref []byte, id int) {
+	tree.add(out, &Node{Type: FootnoteRef, Name: copyBytes(ref), NoteID: id}, nil)
+}
+
+func (tree *treeRenderer) Entity(out *bytes.Buffer, entity []byte) {
+	tree.add(out, &Node{Type: Entity, Literal: copyBytes(entity)}, nil)
+}
+
+func (tree *treeRenderer) NormalText(out *bytes.Buffer, text []byte) {
+	if len(text) == 0 {
+		return
+	}
+
+	// text carrying on from the last text written shares its reference, so
+	// that the parser can still look back at all of it, but keeps a node of
+	// its own: renderers such as SmartyPants see each call separately
+	node := &Node{Type: Text, Literal: copyBytes(text), Span: tree.span}
+	if last := tree.text; last != nil && tree.textOut == out && tree.textEnd == out.Len() &&
+		tree.textSpan.End == tree.span.Start {
+		tree.joined[last] = append(tree.joined[last], node)
+	} else {
+		tree.text = node
+		tree.write(out, node)
+	}
+	tree.textSpan = tree.span
+
+	for {
+		i := bytes.IndexByte(text, 0)
+		if i < 0 {
+			out.Write(text)
+			break
+		}
+		out.Write(text[:i+1])
+		out.WriteByte(0)
+		text = text[i+1:]
+	}
+	tree.textOut, tree.textEnd = out, out.Len()
+}
+
+func (tree *treeRenderer) DocumentHeader(out *bytes.Buffer) {}
+
+func (tree *treeRenderer) DocumentFooter(out *bytes.Buffer) {}
+
+func (tree *treeRenderer) GetFlags() int {
+	return 0
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+// RenderNode replays a tree built by Parse, or any part of it, into a
+// Renderer, and returns the output. Rendering the Document returned by
+// Parse gives the same output as MarkdownOptions.
+func RenderNode(renderer Renderer, node *Node) []byte {
+	var out bytes.Buffer
+	renderNode(renderer, &out, node)
+	return out.Bytes()
+}
+
+// renderChildren renders the children of n on their own, for the callbacks
+// that take their content as a byte slice
+func renderChildren(r Renderer, n *Node) []byte {
+	var out bytes.Buffer
+	for _, child := range n.Children {
+		renderNode(r, &out, child)
+	}
+	return out.Bytes()
+}
+
+func renderNode(r Renderer, out *bytes.Buffer, n *Node) {
+	children := func() bool {
+		for _, child := range n.Children {
+			renderNode(r, out, child)
+		}
+		return true
+	}
+
+	switch n.Type {
+	case Document:
+		// a title block goes first, so the document header can use it
+		rest := n.Children
+		var title bytes.Buffer
+		if len(rest) > 0 && rest[0].Type == TitleBlock {
+			renderNode(r, &title, rest[0])
+			rest = rest[1:]
+		}
+		r.DocumentHeader(out)
+		out.Write(title.Bytes())
+		for _, child := range rest {
+			renderNode(r, out, child)
+		}
+		r.DocumentFooter(out)
+	case TitleBlock:
+		r.TitleBlock(out, n.Literal)
+	case BlockCode:
+		r.BlockCode(out, n.Literal, n.Info)
+	case BlockQuote:
+		r.BlockQuote(out, renderChildren(r, n))
+	case BlockHtml:
+		r.BlockHtml(out, n.Literal)
+	case Header:
+		r.Header(out, children, n.Level, n.ID)
+	case HRule:
+		r.HRule(out)
+	case List:
+		r.List(out, children, n.Flags, n.Start)
+	case ListItem:
+		// the parser drops the newlines that end the content of an item
+		r.ListItem(out, bytes.TrimRight(renderChildren(r, n), "\n"), n.Flags)
+	case Paragraph:
+		r.Paragraph(out, children)
+	case Table:
+		// the rows of header cells make up the header
+		var header, body bytes.Buffer
+		for _, row := range n.Children {
+			if len(row.Children) > 0 && row.Children[0].Type == TableHeaderCell {
+				renderNode(r, &header, row)
+			} else {
+				renderNode(r, &body, row)
+			}
+		}
+		r.Table(out, header.Bytes(), body.Bytes(), n.Columns)
+	case TableRow:
+		r.TableRow(out, renderChildren(r, n))
+	case TableHeaderCell:
+		r.TableHeaderCell(out, renderChildren(r, n), n.Flags)
+	case TableCell:
+		r.TableCell(out, renderChildren(r, n), n.Flags)
+	case Footnotes:
+		r.Footnotes(out, children)
+	case FootnoteItem:
+		r.FootnoteItem(out, n.Name, bytes.TrimRight(renderChildren(r, n), "\n"), n.Flags)
+	case AutoLink:
+		r.AutoLink(out, n.Destination, n.Flags)
+	case CodeSpan:
+		r.CodeSpan(out, n.Literal)
+	case Emphasis:
+		r.Emphasis(out, renderChildren(r, n))
+	case DoubleEmphasis:
+		r.DoubleEmphasis(out, renderChildren(r, n))
+	case TripleEmphasis:
+		r.TripleEmphasis(out, renderChildren(r, n))
+	case StrikeThrough:
+		r.StrikeThrough(out, renderChildren(r, n))
+	case LineBreak:
+		r.LineBreak(out)
+	case Link:
+		r.Link(out, n.Destination, n.Title, renderChildren(r, n))
+	case Image:
+		r.Image(out, n.Destination, n.Title, n.Literal)
+	case RawHtmlTag:
+		r.RawHtmlTag(out, n.Literal)
+	case FootnoteRef:
+		r.FootnoteRef(out, n.Name, n.NoteID)
+	case Entity:
+		r.Entity(out, n.Literal)
+	case Text:
+		r.NormalText(out, n.Literal)
+	}
+}
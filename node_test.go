@@ -0,0 +1,133 @@
+//
+// node_test.go
+// Copyright (C) 2016 wanglong <wanglong@laoqinren.net>
+//
+// Distributed under terms of the MIT license.
+//
+
+package markdown
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	assert := require.New(t)
+
+	doc := Parse([]byte("# Title {#top}\n\nSome *emphasis* and `code`.\n"),
+		Options{Extensions: EXTENSION_HEADER_IDS})
+	assert.Equal(Document, doc.Type)
+	assert.Len(doc.Children, 2)
+
+	header := doc.Children[0]
+	assert.Equal(Header, header.Type)
+	assert.Equal(1, header.Level)
+	assert.Equal("top", header.ID)
+	assert.Equal(doc, header.Parent)
+	assert.Len(header.Children, 1)
+	assert.Equal("Title", string(header.Children[0].Literal))
+
+	para := doc.Children[1]
+	assert.Equal(Paragraph, para.Type)
+	var types []NodeType
+	for _, child := range para.Children {
+		types = append(types, child.Type)
+	}
+	assert.Equal([]NodeType{Text, Emphasis, Text, CodeSpan, Text}, types)
+	assert.Equal("emphasis", string(para.Children[1].Children[0].Literal))
+	assert.Equal("code", string(para.Children[3].Literal))
+}
+
+func TestParseList(t *testing.T) {
+	assert := require.New(t)
+
+	doc := Parse([]byte("3. one\n4. [two](/url \"title\")\n"), Options{})
+	assert.Len(doc.Children, 1)
+
+	list := doc.Children[0]
+	assert.Equal(List, list.Type)
+	assert.Equal(LIST_TYPE_ORDERED, list.Flags&LIST_TYPE_ORDERED)
+	assert.Equal(3, list.Start)
+	assert.Len(list.Children, 2)
+
+	link := list.Children[1].Children[0]
+	assert.Equal(Link, link.Type)
+	assert.Equal("/url", string(link.Destination))
+	assert.Equal("title", string(link.Title))
+	assert.Equal("two", string(link.Children[0].Literal))
+}
+
+func TestParseKeepsZeroBytes(t *testing.T) {
+	assert := require.New(t)
+
+	doc := Parse([]byte("a\x00b *c\x00*\n"), Options{})
+	para := doc.Children[0]
+	assert.Equal("a\x00b ", string(para.Children[0].Literal))
+	assert.Equal("c\x00", string(para.Children[1].Children[0].Literal))
+}
+
+func TestWalk(t *testing.T) {
+	assert := require.New(t)
+
+	doc := Parse([]byte("para *one*\n\npara **two**\n"), Options{})
+
+	var visited []string
+	doc.Walk(func(node *Node, entering bool) WalkStatus {
+		if entering {
+			visited = append(visited, "+"+node.Type.String())
+		} else {
+			visited = append(visited, "-"+node.Type.String())
+		}
+		if node.Type == Emphasis {
+			return SkipChildren
+		}
+		if node.Type == DoubleEmphasis {
+			return Terminate
+		}
+		return GoToNext
+	})
+	assert.Equal([]string{
+		"+Document",
+		"+Paragraph", "+Text", "+Emphasis", "-Emphasis", "-Paragraph",
+		"+Paragraph", "+Text", "+DoubleEmphasis",
+	}, visited)
+}
+
+func TestRenderNode(t *testing.T) {
+	var tests = []string{
+		"# Header\n\nSome *emphasis*, **strong**, ***both*** and ~~gone~~.\n",
+		"> quote\n> with `code`\n\n---\n",
+		"* one\n* two\n\n    * nested\n\n1. first\n2. second\n",
+		"Term\n: definition\n\nOther\n: more\n",
+		"| a | b |\n|:--|--:|\n| 1 | 2 |\n| 3 | 4 |\n",
+		"```go\nfunc main() {}\n```\n",
+		"<div>\nhtml\n</div>\n\ntext with <span>tags</span> &amp; &copy;\n",
+		"[link](/url \"title\") ![image](/img.png) <http://example.com/>\n",
+		"line  \nbreak\n\n[ref][1]\n\n[1]: /ref\n",
+		"text[^note]\n\n[^note]: the note\n",
+		"text[^long]\n\n[^long]: first\n\n    second\n",
+		"% Title\n% Author\n\nbody\n",
+		"\\\"quoted\\\" and \\'single\\' -- 1/2...\n",
+		"<a href=\"\\\"\">\n",
+	}
+
+	extensions := EXTENSION_TABLES | EXTENSION_FENCED_CODE | EXTENSION_AUTOLINK |
+		EXTENSION_STRIKETHROUGH | EXTENSION_FOOTNOTES | EXTENSION_TITLEBLOCK |
+		EXTENSION_DEFINITION_LISTS | EXTENSION_AUTO_HEADER_IDS
+
+	// SmartyPants keeps state from one call to the next, so the tree has
+	// to give the renderer the text in the same calls as the parser
+	smartypants := HTML_USE_SMARTYPANTS | HTML_SMARTYPANTS_FRACTIONS | HTML_SMARTYPANTS_DASHES
+	for _, flags := range []int{HTML_USE_XHTML, smartypants, smartypants | HTML_SMARTYPANTS_ANGLED_QUOTES} {
+		for _, input := range tests {
+			expected := Markdown([]byte(input), HtmlRenderer(flags, "", ""), extensions)
+			doc := Parse([]byte(input), Options{Extensions: extensions})
+			actual := RenderNode(HtmlRenderer(flags, "", ""), doc)
+			if string(actual) != string(expected) {
+				t.Errorf("\nFlags	[%#x]\nInput	[%#v]\nExpected[%#v]\nActual	[%#v]",
+					flags, input, string(expected), string(actual))
+			}
+		}
+	}
+}
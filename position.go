@@ -0,0 +1,309 @@
+//
+// position.go
+// Copyright (C) 2016 wanglong <wanglong@laoqinren.net>
+//
+// Distributed under terms of the MIT license.
+//
+
+//
+//
+// Source positions
+//
+//
+
+package markdown
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+// Position is a place in the input given to the parser
+type Position struct {
+	Offset int // byte offset, starting at 0
+	Line   int // line number, starting at 1
+	Column int // byte offset within the line, starting at 1
+}
+
+// Span is the part of the input an element was parsed from. End is the
+// position just past its last byte.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// PositionRenderer is a Renderer that also wants to know where each element
+// comes from. The parser calls SetSpan just before each callback that
+// renders an element, including NormalText, with the span of that element
+// in the original input, before tab expansion and newline normalization.
+// Elements that have no place in the input, such as the list of footnotes,
+// get a zero Span.
+type PositionRenderer interface {
+	Renderer
+	SetSpan(span Span)
+}
+
+// lineIndex turns byte offsets of an input into positions
+type lineIndex struct {
+	starts []int // offset of the start of each line
+	size   int   // size of the input
+}
+
+func newLineIndex(input []byte) *lineIndex {
+	index := &lineIndex{starts: []int{0}, size: len(input)}
+	for i := 0; i < len(input); i++ {
+		switch {
+		case input[i] == '\r' && i+1 < len(input) && input[i+1] == '\n':
+			// the \n ends this line
+		case input[i] == '\n', input[i] == '\r':
+			index.starts = append(index.starts, i+1)
+		}
+	}
+	return index
+}
+
+func (index *lineIndex) position(offset int) Position {
+	if offset > index.size {
+		offset = index.size
+	}
+	line := sort.Search(len(index.starts), func(i int) bool {
+		return index.starts[i] > offset
+	}) - 1
+	return Position{
+		Offset: offset,
+		Line:   line + 1,
+		Column: offset - index.starts[line] + 1,
+	}
+}
+
+// trackSources sets up the source maps that lead from the buffers the parser
+// works on back to input
+func (p *parser) trackSources(input []byte) {
+	if p.sources != nil {
+		return
+	}
+	p.lines = newLineIndex(input)
+	p.sources = make(map[*byte]*sourceMap)
+	p.addSource(&sourceMap{segments: []segment{{copied: true}}}, input)
+}
+
+// A sourceMap maps the bytes of a buffer the parser works on back to the
+// input. The buffer is made up of segments, each either copied from the
+// input or standing in for some of it, as the spaces of an expanded tab
+// stand in for the tab.
+type sourceMap struct {
+	segments []segment
+	capacity int // capacity of the buffer, to locate the parts of it
+}
+
+type segment struct {
+	at     int  // offset in the buffer
+	source int  // offset in the input
+	size   int  // size of the input a stand-in segment replaces
+	copied bool // whether the bytes are copied as is
+}
+
+// add appends a segment, merging it with the last one when it simply
+// carries on copying the input
+func (m *sourceMap) add(seg segment) {
+	if n := len(m.segments); n > 0 {
+		last := m.segments[n-1]
+		if seg.copied && last.copied && seg.source-last.source == seg.at-last.at {
+			return
+		}
+		if last.at == seg.at {
+			m.segments = m.segments[:n-1]
+		}
+	}
+	m.segments = append(m.segments, seg)
+}
+
+// find returns the index of the segment holding byte i of the buffer
+func (m *sourceMap) find(i int) int {
+	return sort.Search(len(m.segments), func(k int) bool {
+		return m.segments[k].at > i
+	}) - 1
+}
+
+// source returns the part of the input byte i of the buffer comes from
+func (m *sourceMap) source(i int) (start, end int) {
+	k := m.find(i)
+	if k < 0 {
+		return 0, 0
+	}
+	seg := m.segments[k]
+	if seg.copied {
+		start = seg.source + i - seg.at
+		return start, start + 1
+	}
+	return seg.source, seg.source + seg.size
+}
+
+// sourceKey identifies the buffer data is a part of, by the last byte of
+// the array behind it
+func sourceKey(data []byte) *byte {
+	if cap(data) == 0 {
+		return nil
+	}
+	return &data[:cap(data)][cap(data)-1]
+}
+
+// addSource registers the source map of a buffer, once it is complete
+func (p *parser) addSource(m *sourceMap, data []byte) {
+	if p.sources == nil || cap(data) == 0 {
+		return
+	}
+	m.capacity = cap(data)
+	p.sources[sourceKey(data)] = m
+}
+
+// lookup returns the source map of the buffer data is a part of, and the
+// offset of data in that buffer
+func (p *parser) lookup(data []byte) (*sourceMap, int) {
+	key := sourceKey(data)
+	if key == nil {
+		return nil, 0
+	}
+	m := p.sources[key]
+	if m == nil {
+		return nil, 0
+	}
+	return m, m.capacity - cap(data)
+}
+
+// copied records that data, a part of the input or of a registered buffer,
+// is written to the buffer of m at offset at
+func (p *parser) copied(m *sourceMap, at int, data []byte) {
+	if p.sources == nil || len(data) == 0 {
+		return
+	}
+	from, offset := p.lookup(data)
+	if from == nil {
+		return
+	}
+	k := from.find(offset)
+	if k < 0 {
+		return
+	}
+	for ; k < len(from.segments) && from.segments[k].at < offset+len(data); k++ {
+		seg := from.segments[k]
+		if seg.at < offset {
+			if seg.copied {
+				seg.source += offset - seg.at
+			}
+			seg.at = offset
+		}
+		seg.at += at - offset
+		m.add(seg)
+	}
+}
+
+// expanded records that line, a part of the input, is written to the buffer
+// of m at offset at by expandTabs
+func (p *parser) expanded(m *sourceMap, at int, line []byte, tabSize int) {
+	if p.sources == nil || len(line) == 0 {
+		return
+	}
+	from, offset := p.lookup(line)
+	if from == nil {
+		return
+	}
+	source, _ := from.source(offset)
+
+	// this follows the tab stops of expandTabs
+	column := 0
+	for i := 0; i < len(line); {
+		if line[i] != '\t' {
+			m.add(segment{at: at, source: source + i, copied: true})
+			for i < len(line) && line[i] != '\t' {
+				_, size := utf8.DecodeRune(line[i:])
+				i += size
+				at += size
+				column++
+			}
+			continue
+		}
+
+		m.add(segment{at: at, source: source + i, size: 1})
+		for {
+			at++
+			column++
+			if column%tabSize == 0 {
+				break
+			}
+		}
+		i++
+	}
+}
+
+// replaced records that the bytes written to the buffer of m at offset at
+// stand in for data, a part of the input, as a newline stands in for \r\n
+func (p *parser) replaced(m *sourceMap, at int, data []byte) {
+	if p.sources == nil || len(data) == 0 {
+		return
+	}
+	from, offset := p.lookup(data)
+	if from == nil {
+		return
+	}
+	start, _ := from.source(offset)
+	_, end := from.source(offset + len(data) - 1)
+	m.add(segment{at: at, source: start, size: end - start})
+}
+
+// position returns where data, a part of the input or of a registered
+// buffer, starts in the input
+func (p *parser) position(data []byte) Position {
+	m, offset := p.lookup(data)
+	if m == nil {
+		return Position{}
+	}
+	start, _ := m.source(offset)
+	return p.lines.position(start)
+}
+
+// move records that the block or inline loop moved on to data, stopping
+// the parser of locate once it gets past where the first parse broke down
+func (p *parser) move(data []byte) {
+	if p.moves++; p.stopAt > 0 && p.moves > p.stopAt {
+		panic(located{})
+	}
+	p.at = data
+}
+
+// span tells a PositionRenderer the span of the element about to be
+// rendered, which was parsed from data
+func (p *parser) span(data []byte) {
+	p.spanAround(data, 0)
+}
+
+// spanAround is span for an element that also takes up the before bytes
+// ahead of data, such as the delimiters of emphasis
+func (p *parser) spanAround(data []byte, before int) {
+	if p.pr == nil {
+		return
+	}
+	m, offset := p.lookup(data)
+	if m == nil {
+		p.pr.SetSpan(Span{})
+		return
+	}
+	offset -= before
+	start, end := m.source(offset)
+	if size := len(data) + before; size == 0 {
+		end = start
+	} else {
+		_, end = m.source(offset + size - 1)
+	}
+	p.pr.SetSpan(Span{Start: p.lines.position(start), End: p.lines.position(end)})
+}
+
+// blockSpan is span for a block, leaving out the newline and any blank
+// lines that end it
+func (p *parser) blockSpan(data []byte) {
+	end := len(data)
+	for end > 0 && (data[end-1] == '\n' || data[end-1] == ' ') {
+		end--
+	}
+	p.span(data[:end])
+}
@@ -0,0 +1,90 @@
+//
+// position_test.go
+// Copyright (C) 2016 wanglong <wanglong@laoqinren.net>
+//
+// Distributed under terms of the MIT license.
+//
+
+package markdown
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// spans lists the nodes of the tree with the input they come from
+func spans(input string, extensions int) []string {
+	var list []string
+	Parse([]byte(input), Options{Extensions: extensions}).Walk(func(node *Node, entering bool) WalkStatus {
+		if entering && node.Type != Document {
+			span := node.Span
+			list = append(list, fmt.Sprintf("%v %d:%d %q", node.Type, span.Start.Line, span.Start.Column,
+				input[span.Start.Offset:span.End.Offset]))
+		}
+		return GoToNext
+	})
+	return list
+}
+
+func TestSpans(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal([]string{
+		`Header 1:1 "# Head *x*"`,
+		`Text 1:3 "Head "`,
+		`Emphasis 1:8 "*x*"`,
+		`Text 1:9 "x"`,
+		`Paragraph 3:1 "a\tb **c**\r\n` + "`d`" + `"`,
+		`Text 3:1 "a\tb "`,
+		`DoubleEmphasis 3:5 "**c**"`,
+		`Text 3:7 "c"`,
+		`Text 3:10 "\r\n"`,
+		`CodeSpan 4:1 "` + "`d`" + `"`,
+	}, spans("# Head *x*\r\n\r\na\tb **c**\r\n`d`\r\n", 0))
+
+	assert.Equal([]string{
+		`BlockQuote 1:1 "> * one\n>   two"`,
+		`List 1:3 "* one\n>   two"`,
+		`ListItem 1:3 "* one\n>   two"`,
+		`Text 1:5 "one"`,
+		`Text 1:8 "\n>   two"`,
+	}, spans("> * one\n>   two\n", 0))
+
+	assert.Equal([]string{
+		`Paragraph 1:1 "a_b@x.co ![i](/i) &amp;"`,
+		`AutoLink 1:1 "a_b@x.co"`,
+		`Text 1:9 " "`,
+		`Image 1:10 "![i](/i)"`,
+		`Text 1:18 " "`,
+		`Entity 1:19 "&amp;"`,
+	}, spans("a_b@x.co ![i](/i) &amp;", EXTENSION_AUTOLINK))
+
+	assert.Equal([]string{
+		`Paragraph 1:1 "x[^n]"`,
+		`Text 1:1 "x"`,
+		`FootnoteRef 1:2 "[^n]"`,
+		`Footnotes 0:0 ""`,
+		`FootnoteItem 3:7 "a\tb"`,
+		`Text 3:7 "a\tb"`,
+	}, spans("x[^n]\n\n[^n]: a\tb\n", EXTENSION_FOOTNOTES))
+}
+
+func TestLineIndex(t *testing.T) {
+	assert := require.New(t)
+
+	index := newLineIndex([]byte("ab\ncd\r\nef\rg"))
+	tests := map[int]Position{
+		0:  {0, 1, 1},
+		2:  {2, 1, 3},
+		3:  {3, 2, 1},
+		6:  {6, 2, 4},
+		7:  {7, 3, 1},
+		10: {10, 4, 1},
+		11: {11, 4, 2},
+		20: {11, 4, 2},
+	}
+	for offset, position := range tests {
+		assert.Equal(position, index.position(offset))
+	}
+}
@@ -9,6 +9,7 @@ package markdown
 
 import (
 	"bytes"
+	"html"
 	"unicode"
 	"unicode/utf8"
 )
@@ -31,6 +32,16 @@ func skipUntilChar(input []byte, start int, ch byte) int {
 	return i
 }
 
+// skipLine returns the start of the line following input[start], or the
+// end of input if it has no more newlines
+func skipLine(input []byte, start int) int {
+	i := skipUntilChar(input, start, '\n')
+	if i < len(input) {
+		i++
+	}
+	return i
+}
+
 func escapeSingleChar(ch byte) (string, bool) {
 	if ch == '"' {
 		return "&quot;", true
@@ -66,6 +77,88 @@ func attrEscape(out *bytes.Buffer, src []byte) {
 	}
 }
 
+// unescapeText copies src to out, dropping the backslash of each escape
+func unescapeText(out *bytes.Buffer, src []byte) {
+	i := 0
+	for i < len(src) {
+		org := i
+		for i < len(src) && src[i] != '\\' {
+			i++
+		}
+
+		if i > org {
+			out.Write(src[org:i])
+		}
+
+		if i+1 >= len(src) {
+			break
+		}
+
+		out.WriteByte(src[i+1])
+		i += 2
+	}
+}
+
+// linkScheme returns the lower case scheme of a link, such as "http", or
+// an empty string if the link has none
+func linkScheme(link []byte) string {
+	for i, ch := range link {
+		switch {
+		case ch == ':' && i > 0:
+			return string(bytes.ToLower(link[:i]))
+		case isletter(ch), i > 0 && (isalnum(ch) || ch == '+' || ch == '-' || ch == '.'):
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// isRelativeLink tells whether a link points into the current site
+func isRelativeLink(link []byte) bool {
+	return linkScheme(link) == "" && !bytes.HasPrefix(link, []byte("//"))
+}
+
+// isSafeLink tells whether a link is relative or uses a well known scheme.
+// Browsers drop the spaces and control characters leading a link, and tabs
+// and newlines anywhere in it, so the scheme is looked for without them; a
+// link with any other control character is never safe.
+func isSafeLink(link []byte) bool {
+	var clean []byte
+	for _, ch := range link {
+		switch {
+		case ch == '\t' || ch == '\n' || ch == '\r':
+		case ch <= ' ' && len(clean) == 0:
+		case ch < ' ' || ch == 0x7f:
+			return false
+		default:
+			clean = append(clean, ch)
+		}
+	}
+	switch linkScheme(clean) {
+	case "", "http", "https", "ftp", "mailto":
+		return true
+	}
+	return false
+}
+
+// isHtmlTag tells whether tag is an opening or closing html tag of the
+// given name
+func isHtmlTag(tag []byte, name string) bool {
+	i := 1
+	if i < len(tag) && tag[i] == '/' {
+		i++
+	}
+	if len(tag) < i+len(name)+1 || tag[0] != '<' {
+		return false
+	}
+	if !bytes.EqualFold(tag[i:i+len(name)], []byte(name)) {
+		return false
+	}
+	c := tag[i+len(name)]
+	return c == '>' || c == '/' || isspace(c)
+}
+
 // expandTabs replace tab characters with spaces. aligning to the next TAB_SIZE column.
 // always ends output with a newline
 func expandTabs(out *bytes.Buffer, line []byte, tabSize int) {
@@ -128,13 +221,23 @@ func expandTabs(out *bytes.Buffer, line []byte, tabSize int) {
 // check if the specified position is preceded by an odd number of backslashes
 func isBackslashEscaped(data []byte, i int) bool {
 	backslashes := 0
-	for i-backslashes >= 0 && data[i-backslashes-1] == '\\' {
+	for i-backslashes-1 >= 0 && data[i-backslashes-1] == '\\' {
 		backslashes++
 	}
 
 	return backslashes&1 == 1
 }
 
+// isNamedEntity tells whether entity, such as "&copy;", names a character
+// in the HTML5 entity table
+func isNamedEntity(entity []byte) bool {
+	s := string(entity)
+	// the html package also decodes legacy entities missing their ';' at
+	// the start of a longer name, leaving the rest of the name behind
+	u := html.UnescapeString(s)
+	return u != s && utf8.RuneCountInString(u) <= 2
+}
+
 // SanitizedString returns a sanitized string for the given text.
 func SanitizedString(text string) string {
 	var anchorName []rune
@@ -166,9 +269,19 @@ func isletter(c byte) bool {
 	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
 }
 
+// isdigit test if a character is a decimal digit
+func isdigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isxdigit test if a character is a hexadecimal digit
+func isxdigit(c byte) bool {
+	return isdigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
 // isalnum test if a character is a letter or a digit
 func isalnum(c byte) bool {
-	return (c >= '0' && c <= '9') || isletter(c)
+	return isdigit(c) || isletter(c)
 }
 
 // ispunct test if a character is a puncuation symbol
@@ -182,6 +295,24 @@ func ispunct(c byte) bool {
 	return false
 }
 
+// hasPrefixFold tells whether data starts with prefix, an ASCII lower case
+// string, ignoring the case of the ASCII letters of data
+func hasPrefixFold(data []byte, prefix string) bool {
+	if len(data) < len(prefix) {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		c := data[i]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func doubleSpace(out *bytes.Buffer) {
 	if out.Len() > 0 {
 		out.WriteByte('\n')